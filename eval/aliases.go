@@ -0,0 +1,83 @@
+package eval
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// the prefixes of the aliases that expandAliases always knows
+var builtinAliases = map[string]bool{"p": true, "t": true, "e": true, "pj": true, "pt": true, "pr": true, "ph": true}
+
+type customAlias struct {
+	prefix string
+	pat    *regexp.Regexp
+	expand func(args string) string
+}
+
+// Aliases added with RegisterAlias, in the order they were registered
+type aliasRegistry struct {
+	sync.Mutex
+	list []customAlias
+}
+
+// the aliases added with the package-level RegisterAlias, used unless an Evaluator has
+// aliases of its own
+var customAliases aliasRegistry
+
+// RegisterAlias adds an alias to the builtin ones such as "p": a statement consisting of
+// prefix, followed by spaces and then args, is replaced by expand(args). For example,
+//
+//	RegisterAlias("dump", func(args string) string { return "spew.Dump(" + args + ")" })
+//
+// turns "dump x, y" into "spew.Dump(x, y)". Like the builtin aliases, prefix is only
+// recognized at the start of a statement, and not if it is followed by "=", ":", "(", an
+// assignment or send (as in "dump := 1", "dump += 1" or "dump <- 1"), or an operator that
+// is only binary ("dump != nil"). A unary operator may start args, as in "dump -x" or
+// "dump <-ch"; args has no trailing whitespace. The builtin aliases are expanded first,
+// and the registered ones are tried in the order they were registered, but as their
+// prefixes must differ, at most one applies to a statement. The expansion isn't itself
+// expanded any further, though packages it refers to are imported as usual.
+//
+// An error is returned if prefix isn't an identifier, is a Go keyword or predeclared
+// name, or is already an alias.
+func RegisterAlias(prefix string, expand func(args string) string) error {
+	return customAliases.register(prefix, expand)
+}
+
+func (r *aliasRegistry) register(prefix string, expand func(args string) string) error {
+	if !isIdent(prefix) || prefix == "_" || notPkgNames[prefix] {
+		return fmt.Errorf("alias %q: not a usable name", prefix)
+	}
+	r.Lock()
+	defer r.Unlock()
+	if builtinAliases[prefix] {
+		return fmt.Errorf("alias %q: conflicts with a builtin alias", prefix)
+	}
+	for _, a := range r.list {
+		if a.prefix == prefix {
+			return fmt.Errorf("alias %q: already registered", prefix)
+		}
+	}
+	pat := regexp.MustCompile(`^\s*` + prefix + `[ \t]+` + aliasArgPat + `$`)
+	r.list = append(r.list, customAlias{prefix, pat, expand})
+	return nil
+}
+
+// Expand stmt with the first registered alias that matches it, if any
+func expandCustomAlias(stmt string, aliases []customAlias) string {
+	for _, a := range aliases {
+		if m := a.pat.FindStringSubmatch(stmt); m != nil {
+			return a.expand(strings.TrimRight(m[1], " \t\r"))
+		}
+	}
+	return stmt
+}
+
+// A snapshot of the registered aliases
+func (r *aliasRegistry) snapshot() []customAlias {
+	r.Lock()
+	defer r.Unlock()
+	return append([]customAlias(nil), r.list...)
+}
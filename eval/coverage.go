@@ -0,0 +1,68 @@
+package eval
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A block of the text coverage profile: "file.go:startLine.startCol,endLine.endCol
+// numStatements count"
+var coverBlockPat = regexp.MustCompile(`^.+:(\d+)\.(\d+),(\d+)\.(\d+) \d+ (\d+)$`)
+
+// Convert the counters that a binary built with -cover left in coverDir into hit counts
+// for the lines of the snippet, given the generated source the binary was built from.
+func lineCoverage(ctx context.Context, opts Options, coverDir string, src string) (map[int]int, error) {
+	profile := filepath.Join(coverDir, "profile.txt")
+	out, err := command(ctx, opts, opts.goBinary(), "tool", "covdata", "textfmt", "-i="+coverDir, "-o="+profile).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	fh, err := os.Open(profile)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	snippetLines := snippetLineNumbers(src)
+	hits := make(map[int]int)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		m := coverBlockPat.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue // the "mode:" header
+		}
+		start, _ := strconv.Atoi(m[1])
+		end, _ := strconv.Atoi(m[3])
+		count, _ := strconv.Atoi(m[5])
+		if m[4] == "1" && end > start {
+			end-- // the block ends before this line does
+		}
+		for l := start; l <= end; l++ {
+			if n, ok := snippetLines[l]; ok && count >= hits[n] {
+				hits[n] = count
+			}
+		}
+	}
+	return hits, scanner.Err()
+}
+
+// Map the lines of generated code that hold the snippet's lines, those just after a
+// "//line :N" directive, to the snippet's line numbers. The lines gore adds (and the
+// rest of a line that spans several, like a raw string) aren't mapped.
+func snippetLineNumbers(src string) map[int]int {
+	lines := make(map[int]int)
+	for i, line := range strings.Split(src, "\n") {
+		if strings.HasPrefix(line, "//line :") {
+			if n, err := strconv.Atoi(line[len("//line :"):]); err == nil {
+				lines[i+2] = n // the next line, numbering from 1
+			}
+		}
+	}
+	return lines
+}
@@ -6,17 +6,51 @@ package eval
 */
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// gore's version, to be bumped with each release
+const version = "0.2.0"
+
 var (
 	builtinPkgs map[string]string
+	// Other standard packages with the same name as one in builtinPkgs, tried in turn if
+	// the snippet uses something the inferred package doesn't have (see tryAlternatePkgs)
+	alternatePkgs = map[string][]string{
+		"template": {"html/template"},
+		"rand":     {"crypto/rand"},
+		"pprof":    {"runtime/pprof"},
+	}
+	// Keywords and predeclared names, which are never packages, whatever Options.Imports says
+	notPkgNames = map[string]bool{
+		"break": true, "case": true, "chan": true, "const": true, "continue": true, "default": true,
+		"defer": true, "else": true, "fallthrough": true, "for": true, "func": true, "go": true,
+		"goto": true, "if": true, "import": true, "interface": true, "map": true, "package": true,
+		"range": true, "return": true, "select": true, "struct": true, "switch": true, "type": true,
+		"var": true, "append": true, "cap": true, "clear": true, "close": true, "complex": true,
+		"copy": true, "delete": true, "imag": true, "len": true, "make": true, "max": true, "min": true,
+		"new": true, "panic": true, "print": true, "println": true, "real": true, "recover": true,
+		"any": true, "bool": true, "byte": true, "error": true, "float32": true, "float64": true,
+		"int": true, "int8": true, "int16": true, "int32": true, "int64": true, "rune": true,
+		"string": true, "uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+		"uintptr": true, "complex64": true, "complex128": true, "nil": true, "true": true,
+		"false": true, "iota": true,
+	}
 )
 
 func init() {
@@ -41,7 +75,7 @@ func init() {
 		"math", "crypto/md5", "mime", "mime/multipart",
 		"net", "os", "text/template/parse", "go/parser",
 		"path", "debug/pe", "encoding/pem", "crypto/x509/pkix",
-		"image/png", "net/http/pprof", "go/printer",
+		"image/png", "net/http/pprof", "go/printer", "go/format",
 		"math/rand", "crypto/rc4", "reflect",
 		"regexp", "container/ring", "net/rpc", "crypto/rsa",
 		"runtime", "text/scanner", "crypto/sha1",
@@ -60,6 +94,22 @@ func init() {
 	}
 }
 
+// Version is gore's version, for tools that embed it and depend on newer features
+func Version() string {
+	return version
+}
+
+// SupportedGoPackages maps the names of the standard packages that are imported
+// automatically to their import paths, e.g. "json" to "encoding/json". The map is a copy,
+// and may be modified by the caller.
+func SupportedGoPackages() map[string]string {
+	pkgs := make(map[string]string, len(builtinPkgs))
+	for name, path := range builtinPkgs {
+		pkgs[name] = path
+	}
+	return pkgs
+}
+
 // Eval "evaluates" a multi-line bit of go code by compiling and running it. It
 // returns either a non-blank compiler error, or the combined stdout and stderr output
 // generated by the evaluated code.
@@ -80,32 +130,334 @@ func init() {
 //     a =  {The answer is 42}
 //     The answer is: 42
 //
-// 1. A line of the form "p XXX" is translated to _p(XXX), where _p is an embedded function (see buildMain)
+// 1. A line of the form "p XXX" is translated to _p(XXX), where _p is an embedded function (see optionalHelpers)
 // 2. There is no need to import standard go packages. They are inferred
 //    and imported automatically. (e.g. "fmt" in the code above)
 // 3. The code is automatically wrapped inside a main package and a main function.
 //    Statements are internally reordered, so that import blocks, type declaration blocks and funcs
 //    are pulled to the "top level"; i.e precede the other statements. The remaining statements and blocks
 //    are bundled inside a main function.
-// To examine the generated code, set the envvar TMPDIR or TEMPDIR, and see $TMPDIR/gore_eval.go
+// The generated code is saved in $TMPDIR (or $TEMPDIR) as gore_eval_<random>.go, which is
+// removed once it has run. To examine the generated code, call Explain instead.
+
+// Eval optionally accepts functional options, such as WithTimeout, to tweak its behaviour.
+
+func Eval(code string, opts ...Option) (out string, err string) {
+	return EvalWithOptions(code, NewOptions(opts...))
+}
+
+// Result is the outcome of evaluating a snippet with EvalResult
+type Result struct {
+	// combined stdout and stderr generated by the evaluated code, up to any panic
+	Out string
+	// compiler errors, or the output of a run that failed. Empty on success
+	Err string
+	// with Options.SeparateStderr, what the code wrote to stderr, except for the panic (or
+	// exit status) of a failed run, which is in Err
+	Stderr string
+	// diagnostics that didn't prevent the code from running, such as go vet's findings
+	Warnings []string
+	// with Options.Coverage, the number of times each line of the snippet that holds a
+	// statement ran, keyed by line number. Lines that never ran map to 0. Nil if the
+	// program didn't exit normally (after a panic, say), as its counts are then lost
+	Coverage map[int]int
+	// with Options.Profile, the profile of the run, in the format "go tool pprof" reads
+	Profile []byte
+	// set if the run ended in a panic, which Err reports in full
+	Panic *PanicInfo
+	// set if the snippet couldn't even be partitioned, in which case Err holds its message
+	SyntaxError *SyntaxError
+	// time taken to build the binary in BuildMode; zero in RunMode, where compiling and
+	// running are a single step
+	CompileDuration time.Duration
+	// time taken to run the binary in BuildMode, or by "go run" (compiling included) in RunMode
+	RunDuration time.Duration
+	// with Options.CacheDiagnostics, true if all the packages used came from the go build cache
+	CacheHit bool
+	// what the go tool said about its own work, such as "go: downloading ..." lines, kept
+	// out of Out and Err
+	ToolchainOutput string
+	// true if Err holds compiler errors
+	compileFailed bool
+	// the phase a run was in, as far as is known, for a timeout to report
+	phase string
+}
+
+// A SyntaxError is a problem with the snippet's structure found before compiling it,
+// such as an unclosed bracket
+type SyntaxError struct {
+	Line    int  // line number in the snippet
+	Bracket byte // the unclosed '{' or '(', if that's the problem
+	Msg     string
+}
 
-func Eval(code string) (out string, err string) {
+// Formatted like a compiler error, ":line: msg"
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf(":%d: %s", e.Line, e.Msg)
+}
+
+// EvalWithOptions is Eval, but with the behaviour tweaked by opts. For example,
+// EvalWithOptions("for {}", Options{Timeout: 5 * time.Second}) returns the error
+// "timeout: evaluation exceeded 5s" instead of hanging.
+func EvalWithOptions(code string, opts Options) (out string, err string) {
+	res := EvalResult(code, opts)
+	return res.Out, res.Err
+}
+
+// EvalResult is EvalWithOptions, but returns warnings as well as the output and error.
+func EvalResult(code string, opts Options) (res Result) {
 	defer func() { // error recovery
 		if e := recover(); e != nil {
-			out = ""
-			err = fmt.Sprintf("1:%v", e)
+			res = Result{Err: fmt.Sprintf("1:%v", e)}
 		}
 	}()
 
+	// A REPL user who just hits enter shouldn't have to wait for the compiler
+	if isBlank(code) {
+		return res
+	}
+
+	ctx, cancel := opts.context()
+	defer cancel()
+
+	if opts.MinGoVersion != "" {
+		if err := checkGoVersion(ctx, opts); err != nil {
+			return Result{Err: err.Error()}
+		}
+	}
+
 	// No additional wrapping if it has a package declaration already
-	if ok, _ := regexp.MatchString("^ *package ", code); ok {
-		out, err = run(code)
-		return out, err
+	if hasPackageClause(code) {
+		res = run(ctx, code, opts)
+	} else {
+		code = expandAliases(code, opts.customAliases())
+		if opts.AutoCheckErr {
+			code = insertErrChecks(code)
+		}
+		topLevel, nonTopLevel, pkgsToImport, warnings, err := partition(code, opts.knownPkgs())
+		if err != nil {
+			return Result{Err: opts.displayErrors(err.Error()), SyntaxError: err}
+		}
+		opts.addAlwaysImports(topLevel+nonTopLevel, pkgsToImport)
+		if opts.Profile != NoProfile {
+			nonTopLevel = fmt.Sprintf("defer __profile(%q)()\n", opts.Profile.String()) + nonTopLevel
+		}
+		if opts.CatchPanics {
+			// Ahead of the snippet's own defers, so that it runs after them
+			nonTopLevel = "defer __catch()\n" + nonTopLevel
+		}
+		res = buildAndExec(ctx, topLevel, nonTopLevel, pkgsToImport, opts)
+		res.Warnings = append(warnings, res.Warnings...)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		// What the code printed before it was killed may tell where it got stuck
+		res = Result{Out: res.Out, Err: timeoutError(res.phase, opts.Timeout)}
+	}
+
+	if opts.SuppressCompileOutput {
+		if res.compileFailed {
+			res.Err = "compilation failed"
+		}
+		res.Warnings = nil
+	}
+	if opts.SuppressRunOutput {
+		res.Out = ""
+	}
+	if opts.DisplayFilename != "" {
+		res.Err = opts.displayErrors(res.Err)
+		for i, w := range res.Warnings {
+			res.Warnings[i] = opts.displayErrors(w)
+		}
+	}
+	if opts.ValidUTF8 {
+		res.Out = strings.ToValidUTF8(res.Out, "\uFFFD")
+		res.Err = strings.ToValidUTF8(res.Err, "\uFFFD")
+	}
+	return res
+}
+
+// EvalTo is Eval, but streams the output of the evaluated code to w as it is produced,
+// instead of returning it. The code is built before being run (as in BuildMode), so
+// compiler errors are returned in err, and never written to w.
+func EvalTo(w io.Writer, code string, opts ...Option) (err string) {
+	options := NewOptions(opts...)
+	options.output = w
+	return EvalResult(code, options).Err
+}
+
+// Compile compiles code as Eval would, but instead of running the binary, leaves it in
+// $TMPDIR (named like the generated code, see Options.TempPrefix) and returns its path,
+// so that it can be run any number of times. The caller should remove it once done,
+// with Cleanup. Compile errors are reported as Eval reports them, with the snippet's
+// line numbers, in which case there is no binary.
+func Compile(code string, opts ...Option) (binaryPath string, err string) {
+	options := NewOptions(opts...)
+	suffix := ""
+	if runtime.GOOS == "windows" {
+		suffix = ".exe"
+	}
+	f, e := createInTempDir(options.tempPrefix() + "_*" + suffix)
+	if e != nil {
+		return "", e.Error()
+	}
+	f.Close()
+	options.compileTo = f.Name()
+	if isBlank(code) { // which EvalResult doesn't bother compiling
+		code = "package main\n\nfunc main() {}\n"
+	}
+	if res := EvalResult(code, options); res.Err != "" {
+		os.Remove(f.Name())
+		return "", res.Err
+	}
+	return f.Name(), ""
+}
+
+// Cleanup removes a binary returned by Compile
+func Cleanup(binaryPath string) error {
+	return os.Remove(binaryPath)
+}
+
+// RemoveTempFiles removes whatever gore has left in the temp directories (and in
+// opts.ModuleDir, if set) under the names it gives its files, per opts.TempPrefix: the
+// binaries from Compile that weren't passed to Cleanup, the directories of Sessions that
+// weren't closed, and anything left behind by a process that was killed. It's meant as a
+// shutdown (or startup) hook for a long-running host, as it also removes the files of any
+// evaluation in progress, in this or another process using the same prefix. Names that
+// no longer exist, as when it's called concurrently, aren't an error; otherwise, the
+// first error is returned, after trying the rest.
+func RemoveTempFiles(opts ...Option) error {
+	options := NewOptions(opts...)
+	var patterns []string
+	for _, dir := range tempDirs() {
+		patterns = append(patterns, filepath.Join(dir, options.tempPrefix()+"_*"))
+	}
+	if options.ModuleDir != "" {
+		patterns = append(patterns, filepath.Join(options.ModuleDir, "."+options.tempPrefix()+"*"))
+	}
+	var firstErr error
+	for _, pattern := range patterns {
+		names, _ := filepath.Glob(pattern) // the only error is a malformed pattern
+		for _, name := range names {
+			if err := os.RemoveAll(name); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
+	return firstErr
+}
+
+// EvalOK says whether code compiles, and runs to completion without panicking or exiting
+// with a non-zero status.
+func EvalOK(code string, opts ...Option) bool {
+	return EvalResult(code, NewOptions(opts...)).Err == ""
+}
 
-	code = expandAliases(code)
-	topLevel, nonTopLevel, pkgsToImport := partition(code)
-	return buildAndExec(topLevel, nonTopLevel, pkgsToImport)
+// EvalMatrix evaluates code with each of goBinaries (see Options.GoBinary), to compare
+// how different toolchains treat it, and returns the results keyed by binary; a binary
+// listed more than once is evaluated once. The evaluations run concurrently, so that
+// Options.OnPhase is called from goroutines of EvalMatrix's own, though one call at a
+// time, without saying which evaluation moved into the phase.
+func EvalMatrix(code string, goBinaries []string, opts ...Option) map[string]Result {
+	results := make(map[string]Result, len(goBinaries))
+	var mu, phaseMu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool, len(goBinaries))
+	for _, goBinary := range goBinaries {
+		if seen[goBinary] {
+			continue
+		}
+		seen[goBinary] = true
+		options := NewOptions(opts...)
+		options.GoBinary = goBinary
+		if onPhase := options.OnPhase; onPhase != nil {
+			options.OnPhase = func(phase string) {
+				phaseMu.Lock()
+				defer phaseMu.Unlock()
+				onPhase(phase)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := EvalResult(code, options)
+			mu.Lock()
+			results[options.GoBinary] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// EvalExpect evaluates code, and checks that its output is expected. Leading and trailing
+// whitespace, and the difference between "\r\n" and "\n", are ignored. It returns nil if
+// the output matches, or else an error with the compiler or runtime errors, or a diff of
+// the output: expected lines are marked with "-", and those produced instead with "+".
+func EvalExpect(code string, expected string, opts ...Option) error {
+	out, err := Eval(code, opts...)
+	if err != "" {
+		return fmt.Errorf("evaluation failed:\n%s", err)
+	}
+	normalize := func(s string) string { return strings.TrimSpace(strings.ReplaceAll(s, "\r\n", "\n")) }
+	if normalize(out) == normalize(expected) {
+		return nil
+	}
+	return fmt.Errorf("unexpected output:\n%s", lineDiff(normalize(expected), normalize(out)))
+}
+
+// EvalExpectError evaluates code, and checks that it fails, whether to compile or when
+// run, with an error that contains substr, for tests that show what doesn't compile and
+// why. The error is compared with "\r\n" replaced by "\n", as reported by Eval, with
+// the snippet's line numbers (":2: undefined: x"). It returns nil if so, or else an
+// error with the output of a successful evaluation, or the error that didn't match.
+func EvalExpectError(code string, substr string, opts ...Option) error {
+	out, err := Eval(code, opts...)
+	if err == "" {
+		return fmt.Errorf("evaluation succeeded, with output:\n%s", out)
+	}
+	normalize := func(s string) string { return strings.ReplaceAll(s, "\r\n", "\n") }
+	if strings.Contains(normalize(err), normalize(substr)) {
+		return nil
+	}
+	return fmt.Errorf("expected an error containing %q. Instead got:\n%s", substr, err)
+}
+
+// A line by line diff of a and b, based on their longest common subsequence of lines
+func lineDiff(a, b string) string {
+	as, bs := strings.Split(a, "\n"), strings.Split(b, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of as[i:] and bs[j:]
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		switch {
+		case i < len(as) && j < len(bs) && as[i] == bs[j]:
+			diff.WriteString("  " + as[i] + "\n")
+			i++
+			j++
+		case j == len(bs) || i < len(as) && lcs[i+1][j] >= lcs[i][j+1]:
+			diff.WriteString("- " + as[i] + "\n")
+			i++
+		default:
+			diff.WriteString("+ " + bs[j] + "\n")
+			j++
+		}
+	}
+	return diff.String()
 }
 
 // A Chunk is a stretch of text, and is either a comment or a string (possibly multiline), or text by default
@@ -126,15 +478,25 @@ type Chunk struct {
 type State struct {
 	// the current line number, while accumulating chunks
 	lineNum int
-	// inferred set of package names. The map's value is a dummy
-	pkgsToImport map[string]bool
+	// inferred set of import paths, mapped to the package name used in the code
+	pkgsToImport map[string]string
 	isTopLevel   bool
-	// lineNumber where the last bracket was opened
+	// package names that may be inferred, mapped to their import paths
+	knownPkgs map[string]string
+	// true while inside an import declaration, which needs no package inference
+	inImport bool
+	// names used as "name.xxx" that could be packages, mapped to the line they first appear on
+	selectors map[string]int
+	// names used other than as selectors, and names of explicitly imported packages
+	idents map[string]bool
+	// explicitly imported paths, mapped to the name (or alias) they are imported as
+	explicitImports map[string]string
+	// lineNumber where the outermost unclosed bracket was opened
 	brackOpenAt int
+	// the outermost unclosed bracket, '{' or '('
+	brackOpenCh byte
 	// number of parens and curlies that have not been closed
 	brackCount int
-	// One of ')', '}',  or ' ' as a dummy value.
-	closingCh uint8
 	// for each line in input code, an array of chunks
 	chunks map[int][]Chunk
 }
@@ -147,29 +509,35 @@ type State struct {
 // line number in the original source. This way, errors in the user's
 // input are traceable after reordering.
 // pkgsToImport contains standard package names inferred from code
+// warnings flag names that look like packages, but for which no import is known.
+// err is set if a string or bracket isn't closed.
+// There is no limit on the length of a line, such as a minified one; the time taken
+// is linear in the size of the snippet.
 //
-func partition(code string) (topLevel string, nonTopLevel string, pkgsToImport map[string]bool) {
+func partition(code string, knownPkgs map[string]string) (topLevel string, nonTopLevel string, pkgsToImport map[string]string, warnings []string, err *SyntaxError) {
 	state := &State{
-		lineNum:      1,
-		pkgsToImport: make(map[string]bool),
-		isTopLevel:   false,
-		brackOpenAt:  0,
-		closingCh:    ' ',
-		brackCount:   0,
-		chunks:       make(map[int][]Chunk),
+		lineNum:         1,
+		knownPkgs:       knownPkgs,
+		pkgsToImport:    make(map[string]string),
+		selectors:       make(map[string]int),
+		idents:          make(map[string]bool),
+		explicitImports: make(map[string]string),
+		isTopLevel:      false,
+		brackOpenAt:     0,
+		brackCount:      0,
+		chunks:          make(map[int][]Chunk),
 	}
 
 	topLevel = ""
 	nonTopLevel = ""
 	scanner := NewScanner(code)
 	for {
-		chunk, err := nextChunk(scanner)
-		if err != nil {
-			if err == io.EOF {
+		chunk, e := nextChunk(scanner)
+		if e != nil {
+			if e == io.EOF {
 				break
-			} else {
-				panic(err)
 			}
+			return "", "", nil, nil, &SyntaxError{Line: state.lineNum, Msg: e.Error()}
 		}
 		addChunk(state, chunk)
 	}
@@ -184,9 +552,11 @@ func partition(code string) (topLevel string, nonTopLevel string, pkgsToImport m
 	}
 
 	if state.brackCount > 0 {
-		panic(fmt.Sprintf("%d: Bracket or paren not closed. %d", state.brackOpenAt, state.brackCount))
+		return "", "", nil, nil, &SyntaxError{Line: state.brackOpenAt, Bracket: state.brackOpenCh,
+			Msg: fmt.Sprintf("'%c' is never closed", state.brackOpenCh)}
 	}
-	return topLevel, nonTopLevel, state.pkgsToImport
+	warnings = append(unresolvedPackages(state), dropExplicitImports(state)...)
+	return topLevel, nonTopLevel, state.pkgsToImport, warnings, nil
 }
 
 func addLine(lineNum int, code string, line string) string {
@@ -230,55 +600,64 @@ func processLine(lineNum int, state *State) (retLine string) {
 	if !ok {
 		return ""
 	}
-	for _, chunk := range chunks {
-		if chunk.kind == KTEXT {
-			inferPackages(chunk.text, state.pkgsToImport)
-		}
-	}
 
 	// Since import and func declarations are not always on a single line, we need to
 	// accumulate whole blocks, which means we have to look for the closing paren (for imports)
-	// and curly (for func and type declarations). In order to account for
-	// nested parens/curlies, we use a simple (simplistic?) strategy that goes well with
-	// go code: only count open parens/brackets at end of line, and closing parens/curlies
-	// at beginning of line.
+	// and curly (for func and type declarations). A block ends on the line where the
+	// parens and curlies opened so far are all closed, wherever they are on the line, as
+	// in "} else { p 2 }" or " p 3 }".
 
 	// To eliminate the presence of curlies and parens inside comments and strings,
 	// extract text only from TEXT chunks.
 
 	l := strings.TrimLeft(extractTxt(chunks), " \t")
-	if len(l) > 0 {
-		// Is there a '}' or ')' at beginning of line, modulo comments
-		if l[0] == state.closingCh { //
-			state.brackCount--
-			if state.brackCount == 0 {
-				state.closingCh = ' ' // reset; note l[0] can never be ' ' because of TrimSpace
-				state.brackOpenAt = 0
-			}
-		} else if state.brackCount == 0 {
-			// look for func/type/import decls. This is the reason we could not trim trailing spaces
-			// earlier
-			state.isTopLevel = strings.HasPrefix(l, "func ") ||
-				strings.HasPrefix(l, "type ") ||
-				strings.HasPrefix(l, "import ")
-		}
-	}
-	l = strings.TrimSpace(l) // trailing whitespace
-	if len(l) > 0 {
-		// Is there a '{' or '(' at end of line modulo comments
-		switch l[len(l)-1] {
-		case '{':
-			state.closingCh = '}'
-			if state.brackCount == 0 {
-				state.brackOpenAt = state.lineNum
+	if len(l) > 0 && state.brackCount == 0 {
+		// look for func/type/import decls
+		state.inImport = strings.HasPrefix(l, "import ")
+		state.isTopLevel = strings.HasPrefix(l, "func ") ||
+			strings.HasPrefix(l, "type ") ||
+			state.inImport
+	}
+
+	// Comments and strings are never scanned for package references, and neither are
+	// import declarations.
+	prevText := ""
+	for _, chunk := range chunks {
+		if chunk.kind == KTEXT {
+			if !state.inImport {
+				inferPackages(chunk.text, state.knownPkgs, state.pkgsToImport)
 			}
-			state.brackCount++
-		case '(':
-			state.closingCh = ')'
+			scanIdents(chunk.text, lineNum, state)
+			prevText = chunk.text
+		} else if chunk.kind == KSTRING && state.inImport {
+			// An import path's last element is the name the package is usually known by,
+			// unless it is preceded by an alias
+			path := strings.Trim(chunk.text, "\"`")
+			name := path[strings.LastIndex(path, "/")+1:]
+			if f := strings.Fields(prevText); len(f) > 0 && f[len(f)-1] != "import" && isIdent(f[len(f)-1]) {
+				name = f[len(f)-1]
+			}
+			state.idents[name] = true
+			if name != "_" {
+				state.explicitImports[path] = name
+			}
+			prevText = ""
+		}
+	}
+
+	for i := 0; i < len(l); i++ {
+		switch l[i] {
+		case '{', '(':
 			if state.brackCount == 0 {
-				state.brackOpenAt = state.lineNum
+				state.brackOpenAt = lineNum
+				state.brackOpenCh = l[i]
 			}
 			state.brackCount++
+		case '}', ')':
+			// a stray closer is left for the compiler to report
+			if state.brackCount > 0 {
+				state.brackCount--
+			}
 		}
 	}
 
@@ -290,6 +669,39 @@ func processLine(lineNum int, state *State) (retLine string) {
 	return retLine
 }
 
+// true if code is nothing but whitespace, comments and empty statements. Aliases need
+// arguments, so this holds whether or not they have been expanded.
+func isBlank(code string) bool {
+	scanner := NewScanner(code)
+	for {
+		chunk, err := nextChunk(scanner)
+		if err != nil {
+			return err == io.EOF
+		}
+		if chunk.kind == KSTRING || chunk.kind == KTEXT && strings.Trim(chunk.text, " \t\r\n;") != "" {
+			return false
+		}
+	}
+}
+
+// Does code begin with a package clause, once leading blank lines and comments are skipped?
+func hasPackageClause(code string) bool {
+	scanner := NewScanner(code)
+	for {
+		chunk, err := nextChunk(scanner)
+		if chunk.kind == KTEXT {
+			if text := strings.TrimLeft(chunk.text, " \t\r\n"); text != "" {
+				return strings.HasPrefix(text, "package ") || strings.HasPrefix(text, "package\t")
+			}
+		} else if chunk.kind == KSTRING {
+			return false
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
 // Concatenate chunk.text from TEXT chunks into a single string
 func extractTxt(chunks []Chunk) (line string) {
 	line = ""
@@ -303,116 +715,1168 @@ func extractTxt(chunks []Chunk) (line string) {
 
 // "p a,b,c" pretty prints each argument; it effectively expands to fmt.Printf("%+v %+v %+v\n", a, b, c)
 // "t a,b,c" prints the type of each argument; it effectively expands to fmt.Printf("%T %T %T\n", a, b, c)
-// These aliases are expanded only if they are at the beginning of a line, and don't look like
-// a method call or variable assignment (e.g. "p := 10", or "p (100)"
-func expandAliases(code string) string {
-	// Expand "p foo(), 2*3"   to __p(foo(), 2*3). __p is defined in the template in buildMain
-	// Look for p followed by spaces followed by something that doesn't start with =, : or (
-	r := regexp.MustCompile(`(?m)^\s*p +([^\s=:(].*)$`)
-	code = r.ReplaceAllString(code, "__p($1)")
+// "e a,b,c" is "p a,b,c", but prints to stderr
+// "pj a,b,c" prints each argument as indented JSON, falling back to "%+v" for those that
+// can't be marshalled (such as channels and funcs)
+// "pt a,b,c" prints each slice (or array) of structs as a table, with a column for each
+// field; other arguments are printed with "%+v"
+// "pr a,b,c" prints its arguments with fmt.Print, without a newline, so that a line can be
+// built up bit by bit
+// "ph a,b,c" prints each []byte (or byte array, such as a sha256 sum) in hex; other
+// arguments are printed with "%+v"
+// These aliases are expanded only if they are at the beginning of a statement, (i.e. at the
+// beginning of a line or after a ';'), and don't look like a method call or variable
+// assignment (e.g. "p := 10", or "p (100)"), or an operand (e.g. "p < 3", in a for clause
+// with a loop variable named p). Statements that none of them match are tried
+// against the custom ones, those added with RegisterAlias (or Evaluator.RegisterAlias).
+// The arguments of those at the start of a line may continue on the lines after it, up to
+// the one that closes their brackets, as in "p f(\n  1,\n  2)".
+// "//gore:require net/http/pprof", on a line of its own, imports the package for its side
+// effects (as "import _"), for code that needs it but doesn't refer to it by name.
+func expandAliases(code string, custom []customAlias) string {
+	code = expandRequires(code)
+	code = expandMultilineAliases(code)
+
+	// Expand "p foo(), 2*3"   to __p(foo(), 2*3). __p is defined in optionalHelpers
+	// Look for p followed by spaces or tabs followed by something that doesn't start with =,
+	// :, ( or a binary operator, as given by aliasArgPat
+	p := regexp.MustCompile(`^\s*p[ \t]+` + aliasArgPat + `$`)
 
 	// Expand "t foo(), 2*3"   to __t(foo(), 2*3), where __t prints the type of each arg
-	r = regexp.MustCompile(`(?m)^\s*t +([^\s=:(].*)$`)
-	return r.ReplaceAllString(code, "__t($1)")
+	t := regexp.MustCompile(`^\s*t[ \t]+` + aliasArgPat + `$`)
+
+	// Expand "e foo(), 2*3"   to __e(foo(), 2*3), where __e is __p for stderr
+	e := regexp.MustCompile(`^\s*e[ \t]+` + aliasArgPat + `$`)
+
+	// Expand "pj foo(), 2*3"   to __pj(foo(), 2*3), where __pj prints JSON
+	pj := regexp.MustCompile(`^\s*pj[ \t]+` + aliasArgPat + `$`)
+
+	// Expand "pt foo(), 2*3"   to __pt(foo(), 2*3), where __pt prints tables
+	pt := regexp.MustCompile(`^\s*pt[ \t]+` + aliasArgPat + `$`)
+
+	// Expand "pr foo(), 2*3"   to __pr(foo(), 2*3), where __pr prints without a newline
+	pr := regexp.MustCompile(`^\s*pr[ \t]+` + aliasArgPat + `$`)
+
+	// Expand "ph foo(), 2*3"   to __ph(foo(), 2*3), where __ph prints bytes in hex
+	ph := regexp.MustCompile(`^\s*ph[ \t]+` + aliasArgPat + `$`)
+
+	return rewriteLines(code, func(stmt string) string {
+		expanded := p.ReplaceAllString(stmt, "__p($1)")
+		expanded = t.ReplaceAllString(expanded, "__t($1)")
+		expanded = e.ReplaceAllString(expanded, "__e($1)")
+		expanded = pj.ReplaceAllString(expanded, "__pj($1)")
+		expanded = pt.ReplaceAllString(expanded, "__pt($1)")
+		expanded = pr.ReplaceAllString(expanded, "__pr($1)")
+		expanded = ph.ReplaceAllString(expanded, "__ph($1)")
+		if expanded != stmt {
+			return expanded
+		}
+		return expandCustomAlias(stmt, custom)
+	})
+}
+
+// An alias's arguments, which can't start like the rest of an assignment (as in "e += 1"),
+// a send ("e <- 5"), a call of a variable named like the alias, or a binary operator
+// ("e != nil", "p * 2"). An operator that can also be unary starts the arguments if it
+// is followed by its operand, as in "p -1", "p *ptr", "p &T{1}" or "p <-ch".
+const aliasArgPat = `([^\s=:(+\-*/%&|^<>!].*|-[^\s=\-].*|\+[^\s=+].*|[*^!][^\s=].*|&[^\s=&^].*|<-\S.*)`
+
+var errAssignPat = regexp.MustCompile(`^\s*(?:\w+\s*,\s*)*err\s*:=`)
+
+var requirePat = regexp.MustCompile(`^([ \t]*)//gore:require[ \t]+("[^"]*"|\S+)[ \t]*$`)
+
+// Replace each "//gore:require path" line with a blank import of path, on the same line,
+// so that errors in it refer to the directive
+func expandRequires(code string) string {
+	lines := strings.Split(code, "\n")
+	inRawString := false
+	for i, line := range lines {
+		if inRawString {
+			end := strings.IndexByte(line, '`')
+			if end < 0 {
+				continue
+			}
+			line = line[end+1:]
+		} else if m := requirePat.FindStringSubmatch(line); m != nil {
+			path := m[2]
+			if !strings.HasPrefix(path, `"`) {
+				path = strconv.Quote(path)
+			}
+			lines[i] = m[1] + "import _ " + path
+			continue
+		}
+		inRawString = endsInRawString(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// the aliases of expandAliases at the start of a line, whose arguments may continue on the
+// lines after it
+var multilineAliasPat = regexp.MustCompile(`^(\s*)(p|t|e|pj|pt|pr|ph)[ \t]+` + aliasArgPat + `$`)
+
+// Expand the aliases whose arguments leave brackets open at the end of the line, adding
+// the closing ')' of the call after the bracket that closes them on a later line, so
+// that each line keeps its line number. Those whose brackets are never closed are left
+// for the compiler to report.
+func expandMultilineAliases(code string) string {
+	lines := strings.Split(code, "\n")
+	inRawString := false
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if inRawString {
+			end := strings.IndexByte(line, '`')
+			if end < 0 {
+				continue
+			}
+			line = line[end+1:]
+		} else if m := multilineAliasPat.FindStringSubmatch(line); m != nil {
+			if depth, _ := scanBrackets(m[3], 0); depth > 0 {
+				for j := i + 1; j < len(lines); j++ {
+					var end int
+					if depth, end = scanBrackets(lines[j], depth); depth <= 0 && end >= 0 {
+						lines[i] = m[1] + "__" + m[2] + "(" + m[3]
+						lines[j] = lines[j][:end] + ")" + lines[j][end:]
+						line, i = lines[j], j
+						break
+					}
+				}
+			}
+		}
+		inRawString = endsInRawString(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Track the depth of brackets through s, from depth, outside strings and runes and up to
+// a "//" comment or a ";" outside brackets, which ends the statement, returning the depth
+// at its end, and the index just past the last bracket that closed all those open (-1 if
+// none did)
+func scanBrackets(s string, depth int) (endDepth int, lastClose int) {
+	var quote byte
+	lastClose = -1
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && quote != '`' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'' || ch == '`':
+			quote = ch
+		case ch == '/' && i+1 < len(s) && s[i+1] == '/', ch == ';' && depth == 0:
+			return depth, lastClose
+		case ch == '(' || ch == '{' || ch == '[':
+			depth++
+		case ch == ')' || ch == '}' || ch == ']':
+			if depth--; depth == 0 {
+				lastClose = i + 1
+			}
+		}
+	}
+	return depth, lastClose
+}
+
+// Follow each "x, err := ..." statement (or "err := ...") with a check that prints err
+// if it isn't nil, on the same line so that line numbers are unchanged. Statements
+// that continue on the next line are left alone.
+func insertErrChecks(code string) string {
+	return rewriteLines(code, func(stmt string) string {
+		if errAssignPat.MatchString(stmt) && isComplete(stmt) {
+			return stmt + "; if err != nil { __p(err) }"
+		}
+		return stmt
+	})
+}
+
+// Are the brackets in stmt balanced (outside strings and runes), and does it not
+// end in a comma or an operator
+func isComplete(stmt string) bool {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(stmt); i++ {
+		ch := stmt[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && quote != '`' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'' || ch == '`':
+			quote = ch
+		case ch == '(' || ch == '{' || ch == '[':
+			depth++
+		case ch == ')' || ch == '}' || ch == ']':
+			depth--
+		}
+	}
+	trimmed := strings.TrimSpace(stmt)
+	return quote == 0 && depth == 0 && !strings.ContainsAny(trimmed[len(trimmed)-1:], ",+-*/%&|^<>=.")
+}
+
+// Apply rewrite to the statements on each line of code, as rewriteStatements does. The
+// lines that continue a raw string are left alone, up to the string's closing '`'.
+func rewriteLines(code string, rewrite func(stmt string) string) string {
+	lines := strings.Split(code, "\n")
+	inRawString := false
+	for i, line := range lines {
+		prefix := ""
+		if inRawString {
+			end := strings.IndexByte(line, '`')
+			if end < 0 {
+				continue
+			}
+			prefix, line = line[:end+1], line[end+1:]
+		}
+		lines[i] = prefix + rewriteStatements(line, rewrite)
+		inRawString = endsInRawString(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Does line end inside a raw string, which continues on the next line?
+func endsInRawString(line string) bool {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && quote != '`' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'' || ch == '`':
+			quote = ch
+		case ch == '/' && i+1 < len(line) && line[i+1] == '/':
+			return false
+		}
+	}
+	return quote == '`'
 }
 
-var pkgPat = regexp.MustCompile(`(?m)\b[a-z]\w+\.`)
+// the start of a for, if or switch statement, up to its block
+var headerPat = regexp.MustCompile(`^\s*(?:\w+:\s*)?(?:else\s+)?(?:for|if|switch)\b[^{]*$`)
+
+// Apply rewrite to each statement in a line: those separated by semicolons, and those in
+// the blocks that open or close on the line, as in "if x { p 1 } else { p 2 }". Strings,
+// runes and comments are left alone, as is everything after a comment.
+func rewriteStatements(line string, rewrite func(stmt string) string) string {
+	var b strings.Builder
+	var quote byte // the quote char of the string or rune being scanned, if any
+	start, depth := 0, 0
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && quote != '`' {
+				i++ // skip escaped char
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'' || ch == '`':
+			quote = ch
+		case ch == '/' && i+1 < len(line) && (line[i+1] == '/' || line[i+1] == '*'):
+			b.WriteString(rewriteStatement(line[start:i], rewrite))
+			return b.String() + line[i:]
+		case ch == '{':
+			depth++
+		case ch == '}' && depth > 0:
+			depth--
+		case ch == ';' && depth == 0 && headerPat.MatchString(line[start:i]):
+			// separates the clauses of a for, if or switch, not statements
+		case ch == '}' || ch == ';' && depth == 0:
+			// the end of a statement, or of a block opened on an earlier line
+			b.WriteString(rewriteStatement(line[start:i], rewrite))
+			b.WriteByte(ch)
+			start = i + 1
+		}
+	}
+	b.WriteString(rewriteStatement(line[start:], rewrite))
+	return b.String()
+}
+
+// the start of a statement whose last braces are a block, or one that continues an if
+// statement with another block
+var blockHeaderPat = regexp.MustCompile(`^\s*(?:\w+:\s*)?(?:else\s*$|(?:else\s+)?(?:for|if|switch|select)\b)`)
+
+// the signature of a func, up to its body
+var funcHeaderPat = regexp.MustCompile(`\bfunc\b[^{}]*$`)
+
+// Whether the '{' after before, whose matching '}' is at stmt[end], opens a block of
+// statements; before is the text since the end of the last block. The braces of
+// composite literals, and of struct and interface types, don't. Inside a literal, those
+// of an element with an elided type (as in "{{1, 2}}") don't either.
+func opensBlock(stmt string, before string, end int, inLiteral bool) bool {
+	switch trimmed := strings.TrimSpace(before); {
+	case trimmed == "" || strings.HasSuffix(trimmed, ":"):
+		return !inLiteral // a bare block, possibly labeled
+	case strings.HasSuffix(trimmed, "struct") || strings.HasSuffix(trimmed, "interface"):
+		return false
+	case blockHeaderPat.MatchString(before):
+		// a literal in the header (as in "range []int{1, 2} {") is followed by the block
+		after := strings.TrimSpace(stmt[min(end+1, len(stmt)):])
+		return after == "" || strings.HasPrefix(after, "else")
+	}
+	return funcHeaderPat.MatchString(before)
+}
+
+// Apply rewrite to stmt, or if that leaves it unchanged, to the statements in its blocks:
+// those of control flow statements and funcs, but not the elements of composite literals.
+func rewriteStatement(stmt string, rewrite func(stmt string) string) string {
+	if rewritten := rewrite(stmt); rewritten != stmt || !strings.Contains(stmt, "{") {
+		return rewritten
+	}
+	return rewriteBlocks(stmt, rewrite, false)
+}
+
+// Apply rewrite to the statements in the blocks in s, including those of the func
+// literals in composite literals. inLiteral is whether s is the inside of a literal.
+func rewriteBlocks(s string, rewrite func(stmt string) string, inLiteral bool) string {
+	var b strings.Builder
+	var quote byte
+	start := 0
+	clause := 0 // the start of the text since the last block or literal
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && quote != '`' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'' || ch == '`':
+			quote = ch
+		case ch == '{':
+			end := closingBrace(s, i)
+			b.WriteString(s[start : i+1])
+			if opensBlock(s, s[clause:i], end, inLiteral) {
+				b.WriteString(rewriteStatements(s[i+1:end], rewrite))
+				clause = min(end+1, len(s))
+			} else {
+				b.WriteString(rewriteBlocks(s[i+1:end], rewrite, true))
+			}
+			start, i = end, end
+		}
+	}
+	b.WriteString(s[start:])
+	return b.String()
+}
+
+// The index of the '}' matching the '{' at s[open], or len(s) if it isn't closed in s
+func closingBrace(s string, open int) int {
+	var quote byte
+	depth := 0
+	for i := open; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && quote != '`' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'' || ch == '`':
+			quote = ch
+		case ch == '{':
+			depth++
+		case ch == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
 
 // Look for strings of the form "xyz.Abc" or "xyz.abc"; we assume "xyz" is an
 // imported package, and if the compiler barfs, we'll remove that assumption
 // and recompile again. See buildAndExec
-func inferPackages(code string, pkgsToImport map[string]bool) {
-	pkgs := pkgPat.FindAllString(code, -1)
-	for _, pkg := range pkgs {
-		pkg = pkg[:len(pkg)-1] // remove trailing '.'
-		if importPkg, ok := builtinPkgs[pkg]; ok {
-			pkgsToImport[importPkg] = true
+// Scopes aren't tracked, so a local variable named like a package, as in
+// "time := t.Hour(); p time.String()", costs that second compile.
+// This is a single hand-rolled pass over code, equivalent to matching `\b[a-z]\w+\.`,
+// but without a regexp and without collecting the matches first.
+func inferPackages(code string, knownPkgs map[string]string, pkgsToImport map[string]string) {
+	for i := 0; i < len(code); {
+		if !isWordChar(code[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(code) && isWordChar(code[i]) {
+			i++
+		}
+		if i < len(code) && code[i] == '.' && i-start > 1 && code[start] >= 'a' && code[start] <= 'z' {
+			name := code[start:i]
+			if notPkgNames[name] {
+				continue
+			}
+			if importPkg, ok := knownPkgs[name]; ok {
+				pkgsToImport[importPkg] = name
+			}
+		}
+	}
+}
+
+// Does s consist of word characters only (so that it may be an import alias)
+func isIdent(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isWordChar(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Same as \w in a regexp
+func isWordChar(ch byte) bool {
+	return ch == '_' || ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
+
+// Record names used as package-like selectors ("name.xxx", but not "x.name.xxx"), and
+// names used in any other way.
+func scanIdents(code string, lineNum int, state *State) {
+	for i := 0; i < len(code); {
+		if !isWordChar(code[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(code) && isWordChar(code[i]) {
+			i++
+		}
+		name := code[start:i]
+		if i < len(code) && code[i] == '.' && (start == 0 || code[start-1] != '.') {
+			if _, ok := state.selectors[name]; !ok {
+				state.selectors[name] = lineNum
+			}
+		} else {
+			state.idents[name] = true
 		}
 	}
 }
 
-func buildAndExec(topLevel string, nonTopLevel string, pkgsToImport map[string]bool) (out string, err string) {
-	pkgsToImport["fmt"] = true // Explicitly imported in the template below in buildMain
-	// If "fmt" is explicitly imported by the user, the compiler will flag a duplicate import error, and
-	// repairImports takes care of the problem.
+// Names used only as "name.xxx" look like references to packages. Report those that
+// have no known import, in order of appearance
+func unresolvedPackages(state *State) (warnings []string) {
+	var names []string
+	for name := range state.selectors {
+		if len(name) < 2 || name[0] < 'a' || name[0] > 'z' || state.idents[name] || notPkgNames[name] {
+			continue
+		}
+		if _, ok := state.knownPkgs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		li, lj := state.selectors[names[i]], state.selectors[names[j]]
+		return li < lj || li == lj && names[i] < names[j]
+	})
+	for _, name := range names {
+		warnings = append(warnings, fmt.Sprintf("no import known for `%s` (line %d); import it explicitly", name, state.selectors[name]))
+	}
+	return warnings
+}
+
+// Don't infer imports that the user has made explicitly: drop inferred paths that are
+// imported explicitly, and inferred names that an explicit import has claimed. A path
+// explicitly imported under an alias isn't imported again under its usual name;
+// instead, its use by that name is reported.
+func dropExplicitImports(state *State) (warnings []string) {
+	var names []string
+	for path, name := range state.pkgsToImport {
+		alias, explicit := state.explicitImports[path]
+		if !explicit {
+			for _, other := range state.explicitImports {
+				if other == name {
+					delete(state.pkgsToImport, path)
+				}
+			}
+			continue
+		}
+		delete(state.pkgsToImport, path)
+		if alias != name && alias != "." && !state.idents[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return state.selectors[names[i]] < state.selectors[names[j]] })
+	for _, name := range names {
+		path := state.knownPkgs[name]
+		warnings = append(warnings, fmt.Sprintf("`%s` (line %d) is not imported, since %s is imported as `%s`",
+			name, state.selectors[name], path, state.explicitImports[path]))
+	}
+	return warnings
+}
+
+func buildAndExec(ctx context.Context, topLevel string, nonTopLevel string, pkgsToImport map[string]string, opts Options) (res Result) {
 	src := buildMain(topLevel, nonTopLevel, pkgsToImport)
-	out, err = run(src)
-	if err != "" {
-		if repairImports(err, pkgsToImport) {
+	res = run(ctx, src, opts)
+	if res.Err != "" {
+		dupsDetected := repairImports(res.Err, pkgsToImport)
+		added := addMissingImports(res.Err, topLevel, opts.knownPkgs(), pkgsToImport)
+		if dupsDetected || len(added) > 0 {
+			opts.enter(PhaseRepairingImports)
 			src = buildMain(topLevel, nonTopLevel, pkgsToImport)
-			out, err = run(src)
+			retried := run(ctx, src, opts)
+			if !usedWithoutSelector(retried.Err, added) {
+				res = retried
+			}
 		}
 	}
-	return out, err
+	if res.compileFailed {
+		res = tryAlternatePkgs(ctx, topLevel, nonTopLevel, pkgsToImport, opts, res)
+	}
+	if res.compileFailed {
+		res.Err = annotateUnusedImports(res.Err)
+	}
+	return res
+}
+
+// Add opts.AlwaysImport to pkgsToImport, the imports inferred for code (a partitioned
+// snippet), except those whose name code doesn't use. Inferred imports of those names
+// are replaced.
+func (opts Options) addAlwaysImports(code string, pkgsToImport map[string]string) {
+	known := opts.knownPkgs()
+	for _, path := range opts.AlwaysImport {
+		name := path[strings.LastIndex(path, "/")+1:]
+		for n, p := range known {
+			if p == path {
+				name = n
+				break
+			}
+		}
+		if !regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\b`).MatchString(code) {
+			continue
+		}
+		for p, n := range pkgsToImport {
+			if n == name {
+				delete(pkgsToImport, p)
+			}
+		}
+		pkgsToImport[path] = name
+	}
+}
+
+var undefinedMemberPat = regexp.MustCompile(`undefined: (\w+)\.\w+`)
+
+// A compile error such as "undefined: template.HTML" may mean that the wrong package
+// of that name was inferred, here text/template instead of html/template. Try the
+// alternatives, keeping the first that doesn't have the same problem. If none do,
+// res is returned unchanged.
+func tryAlternatePkgs(ctx context.Context, topLevel string, nonTopLevel string, pkgsToImport map[string]string, opts Options, res Result) Result {
+	m := undefinedMemberPat.FindStringSubmatch(res.Err)
+	if m == nil {
+		return res
+	}
+	name := m[1]
+	inferred := builtinPkgs[name]
+	if pkgsToImport[inferred] != name || opts.knownPkgs()[name] != inferred {
+		return res // not one of our guesses
+	}
+	for _, alt := range alternatePkgs[name] {
+		opts.enter(PhaseRepairingImports)
+		pkgs := make(map[string]string, len(pkgsToImport))
+		for path, n := range pkgsToImport {
+			pkgs[path] = n
+		}
+		delete(pkgs, inferred)
+		pkgs[alt] = name
+		altRes := run(ctx, buildMain(topLevel, nonTopLevel, pkgs), opts)
+		if m := undefinedMemberPat.FindStringSubmatch(altRes.Err); !altRes.compileFailed || m == nil || m[1] != name {
+			return altRes
+		}
+	}
+	return res
 }
 
 // Look for compile errors of the form
 //    "test.go:10: xxx redeclared as imported package name"
-// and remove 'xxx' from pkgsToImport
+//    "imported and not used: "xxx""
+// or their equivalents from newer compilers
+//    ":10: xxx redeclared in this block"
+//    "gore_eval.go:3:8: "xxx/yyy" imported and not used"
+// and remove the package from pkgsToImport
 // This is the most fragile part of this tool; it breaks if the compiler error message changes
-func repairImports(err string, pkgsToImport map[string]bool) (dupsDetected bool) {
+func repairImports(err string, pkgsToImport map[string]string) (dupsDetected bool) {
 	dupsDetected = false
-	var pkg string
-	r := regexp.MustCompile(`(?m)(\w+) redeclared as imported package name|imported and not used: "(\w+)"`)
+	r := regexp.MustCompile(`(?m)(\w+) redeclared (?:as imported package name|in this block)|imported and not used: "([\w./-]+)"|"([\w./-]+)" imported (?:as \w+ )?and not used`)
 	for _, match := range r.FindAllStringSubmatch(err, -1) {
-		// Either $1 or $2 will have name of pkg name that's been imported
-		if match[1] != "" {
-			pkg = match[1]
-		} else if match[2] != "" {
-			pkg = match[2]
-		}
-		if pkgsToImport[pkg] {
-			// Was the duplicate import our mistake, due to an incorrect guess? If so ...
-			delete(pkgsToImport, pkg)
-			dupsDetected = true
+		// $1 has the name of a package that's been imported, or $2 or $3 its path
+		for pkg, name := range pkgsToImport {
+			if match[1] == name || match[2]+match[3] == pkg {
+				// Was the duplicate import our mistake, due to an incorrect guess? If so ...
+				delete(pkgsToImport, pkg)
+				dupsDetected = true
+			}
 		}
 	}
 	return dupsDetected
 }
 
-// save in a temp file, and "go run" it
-func run(src string) (output string, err string) {
-	tmpfile := save(src)
-	cmd := exec.Command("go", "run", tmpfile)
-	out, e := cmd.CombinedOutput()
+var undefinedPkgPat = regexp.MustCompile(`(?m)undefined: (\w+)$`)
+
+// The converse of repairImports: look for compile errors of the form "undefined: xxx",
+// where xxx is a known package that inference missed (as in "bytes .Buffer"), and add
+// the package to pkgsToImport. Packages that the user imported explicitly in topLevel, under
+// another name, are left alone (see dropExplicitImports). Returns the names of the packages added.
+func addMissingImports(err string, topLevel string, knownPkgs map[string]string, pkgsToImport map[string]string) (added []string) {
+	for _, match := range undefinedPkgPat.FindAllStringSubmatch(err, -1) {
+		name := match[1]
+		path, ok := knownPkgs[name]
+		if !ok || notPkgNames[name] || pkgsToImport[path] != "" || strings.Contains(topLevel, `"`+path+`"`) {
+			continue
+		}
+		pkgsToImport[path] = name
+		added = append(added, name)
+	}
+	return added
+}
+
+var withoutSelectorPat = regexp.MustCompile(`use of package (\w+) (?:without|not in) selector`)
+
+// Was one of names not a package after all, but an undefined variable named like one
+func usedWithoutSelector(err string, names []string) bool {
+	for _, match := range withoutSelectorPat.FindAllStringSubmatch(err, -1) {
+		for _, name := range names {
+			if match[1] == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var unusedImportPat = regexp.MustCompile(`(?m)^.*imported (?:as \w+ )?and not used.*$`)
+
+// Say whether each unused import error is about an import in the user's code, or one
+// that gore inferred. The former are remapped to the user's line numbers, and the
+// latter refer to the generated code.
+func annotateUnusedImports(err string) string {
+	return unusedImportPat.ReplaceAllStringFunc(err, func(line string) string {
+		if strings.HasPrefix(line, ":") {
+			return line + " (explicit import)"
+		}
+		return line + " (import inferred by gore)"
+	})
+}
+
+// save in a uniquely named temp file, and "go run" it. The subprocess (along with the
+// program built by go run) is killed if ctx expires. The temp file, and any binary
+// built from it, are removed however run returns, so a long-running host doesn't
+// accumulate them; Explain shows the code without running it.
+func run(ctx context.Context, src string, opts Options) (res Result) {
+	// The generated file is named relative to the module, and the go tool runs in it
+	opts.ModuleDir = absPath(opts.ModuleDir)
+	if opts.attributeLines {
+		src = attributeLines(src)
+	}
+	if opts.SourceTransform != nil {
+		src = opts.SourceTransform(src)
+	}
+	if err := deniedImport(src, opts); err != "" {
+		return Result{Err: err, compileFailed: true}
+	}
+	tmpfile := opts.srcFile
+	if tmpfile != "" {
+		if err := os.WriteFile(tmpfile, []byte(src), 0600); err != nil {
+			panic("Unable to write '" + tmpfile + "': " + err.Error())
+		}
+	} else {
+		dir, cleanup := genDir(opts)
+		defer cleanup()
+		tmpfile = save(dir, opts.tempPrefix(), src)
+		defer os.Remove(tmpfile)
+	}
+	if opts.VetAsError {
+		opts.enter(PhaseVetting)
+		if findings := vet(ctx, tmpfile, opts); len(findings) > 0 && ctx.Err() == nil {
+			return Result{Err: strings.Join(findings, "\n") + "\n", compileFailed: true}
+		}
+	}
+	execute := func() (out []byte, e error) {
+		if opts.buildsBinary() {
+			return buildAndRunBinary(ctx, tmpfile, opts, &res)
+		}
+		opts.enter(PhaseCompiling)
+		start := time.Now()
+		out, e = runCmd(command(ctx, opts, opts.goBinary(), opts.goArgs("run", tmpfile)...), nil, opts)
+		res.RunDuration = time.Since(start)
+		var chatter string
+		chatter, out = splitToolchainOutput(out)
+		res.ToolchainOutput += chatter
+		return out, e
+	}
+	out, e := execute()
+	if opts.ShowAllErrors && e != nil && ctx.Err() == nil && isTruncated(out) {
+		opts.allErrors = true
+		out, e = execute()
+	}
+	if ctx.Err() != nil {
+		// EvalResult reports the timeout, along with the output of a run that was killed
+		killed := Result{Err: ctx.Err().Error()}
+		if !bytes.HasPrefix(out, []byte("# command-line-arguments")) {
+			killed.Out = strings.TrimSuffix(string(out), "signal: killed\n")
+			if opts.stderrTag() == stderrMarker {
+				killed.Out, killed.Stderr = splitStderr(killed.Out)
+			}
+		}
+		killed.phase = timeoutPhase(res.phase, killed.Out)
+		return killed
+	}
+	if _, ok := e.(*exec.ExitError); e != nil && !ok {
+		return Result{Err: e.Error()} // the command couldn't be started
+	}
 	if e != nil {
-		err = ""
-		errPat := regexp.MustCompile(`^:(\d+)\[.*\]:(.*)$`)
-		for _, e := range strings.Split(string(out), "\n") {
-			if strings.HasPrefix(e, "# command-line-arguments") {
-				continue
+		if m := toolchainPat.FindSubmatch(out); m != nil {
+			res.Err = fmt.Sprintf("module in %s requires go >= %s, but the installed toolchain is go %s",
+				opts.ModuleDir, m[1], m[2])
+			return res
+		}
+		res.compileFailed = strings.HasPrefix(string(out), "# command-line-arguments")
+		if !res.compileFailed {
+			// Whatever the program printed before failing is kept
+			res.Out, out = splitFailure(out, opts.stderrTag())
+			if opts.stderrTag() == stderrMarker {
+				res.Out, res.Stderr = splitStderr(res.Out)
 			}
-			err += errPat.ReplaceAllString(e, ":$1:$2\n")
 		}
-		return "", err
+		res.Err = formatErrors(string(out), tmpfile)
+		if !res.compileFailed {
+			res.Panic = parsePanic(res.Err)
+		}
+		return res
+	}
+	res.Out = string(out)
+	if opts.stderrTag() == stderrMarker {
+		res.Out, res.Stderr = splitStderr(res.Out)
+	}
+	if opts.Vet && !opts.VetAsError {
+		opts.enter(PhaseVetting)
+		res.Warnings = vet(ctx, tmpfile, opts)
+	}
+	return res
+}
+
+var tooManyErrorsPat = regexp.MustCompile(`(?m)^:\d+(?::\d+)?: too many errors$`)
+
+// Say whether compiler output stops short with "too many errors"
+func isTruncated(out []byte) bool {
+	return bytes.Contains(out, []byte("# command-line-arguments")) && tooManyErrorsPat.Match(out)
+}
+
+// The arguments for a go build or run of tmpfile, with any flags that opts call for
+func (opts Options) goArgs(cmd string, args ...string) []string {
+	if opts.allErrors {
+		args = append([]string{"-gcflags=-e"}, args...)
+	}
+	if opts.Coverage && cmd == "build" {
+		args = append([]string{"-cover", "-covermode=count"}, args...)
+	}
+	return append([]string{cmd}, args...)
+}
+
+var toolchainPat = regexp.MustCompile(`go\.mod requires go >= (\S+) \(running go ([^;)]+)`)
+
+// the go tool's reports on the modules (or toolchain) it fetches, which name a version
+var toolchainChatterPat = regexp.MustCompile(`^go: (?:(?:downloading|extracting|verifying|added|upgraded|downgraded) (?:\S+ v\S+|go\d\S* \(\S+\))(?: => v\S+)?|found \S+ in \S+ v\S+|finding module for package \S+)$`)
+
+// Split the lines that the go tool prints about its own work, such as "go: downloading
+// example.com/m v1.0.0", from the start of out. They precede anything the compiler or
+// the program prints, so later lines are left alone, whatever they look like; so is a
+// first line of the program's that doesn't name a module version.
+func splitToolchainOutput(out []byte) (chatter string, rest []byte) {
+	for len(out) > 0 {
+		end := bytes.IndexByte(out, '\n') + 1
+		if end == 0 {
+			end = len(out)
+		}
+		if !toolchainChatterPat.Match(bytes.TrimRight(out[:end], "\r\n")) {
+			break
+		}
+		chatter += string(out[:end])
+		out = out[end:]
+	}
+	return chatter, out
+}
+
+var failurePat = regexp.MustCompile(`(?m)^(?:panic: |fatal error: |exit status \d+$)`)
+
+// Split the output of a failed run into what the program printed, and the panic (or
+// the runtime's fatal error, or just the exit status) that ended it. stdout and stderr
+// share a pipe, so that the output is in the order it was written, at the cost of
+// relying on the format of the runtime's messages. With stderrPrefix, the lines from
+// stderr are tagged with it, which is removed from those of the failure.
+func splitFailure(out []byte, stderrPrefix string) (printed string, failure []byte) {
+	if stderrPrefix != "" {
+		tagged := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(stderrPrefix))
+		pat := regexp.MustCompile(`(?m)^(?:` + regexp.QuoteMeta(stderrPrefix) + `(?:panic: |fatal error: )|exit status \d+$)`)
+		loc := pat.FindIndex(out)
+		if loc == nil {
+			return "", out
+		}
+		failure = tagged.ReplaceAll(out[loc[0]:], nil)
+		return string(out[:loc[0]]), bytes.ReplaceAll(failure, []byte(unterminatedMarker), nil)
+	}
+	loc := failurePat.FindIndex(out)
+	if loc == nil {
+		return "", out
+	}
+	start := loc[0]
+	if !bytes.HasPrefix(out[start:], []byte("panic: ")) && !bytes.HasPrefix(out[start:], []byte("fatal error: ")) {
+		// If the program's output didn't end in a newline, the panic message follows it
+		// on the same line, before the goroutine traces
+		if tb := bytes.Index(out[:start], []byte("\n\ngoroutine ")); tb >= 0 {
+			if i := max(bytes.LastIndex(out[:tb], []byte("panic: ")), bytes.LastIndex(out[:tb], []byte("fatal error: "))); i >= 0 {
+				start = i
+			}
+		}
+	}
+	return string(out[:start]), out[start:]
+}
+
+var goVersionPat = regexp.MustCompile(`go version go(\d+(?:\.\d+)*)`)
+
+// Check that "go version" is at least opts.MinGoVersion
+func checkGoVersion(ctx context.Context, opts Options) error {
+	out, err := command(ctx, opts, opts.goBinary(), "version").Output()
+	if err != nil {
+		return fmt.Errorf("unable to determine the go version: %v", err)
+	}
+	m := goVersionPat.FindSubmatch(out)
+	if m == nil {
+		return fmt.Errorf("unable to determine the go version from %q", strings.TrimSpace(string(out)))
+	}
+	if compareVersions(string(m[1]), strings.TrimPrefix(opts.MinGoVersion, "go")) < 0 {
+		return fmt.Errorf("go >= %s is required, but the installed toolchain is go%s",
+			strings.TrimPrefix(opts.MinGoVersion, "go"), m[1])
+	}
+	return nil
+}
+
+// Compare dotted versions such as "1.21" and "1.9.2", numerically and component by
+// component, with missing components counting as 0. Returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Prepare a command to run the go tool or a built binary, to be killed if ctx expires.
+// With a ModuleDir, it runs in that directory.
+func command(ctx context.Context, opts Options, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.Dir = opts.ModuleDir
+	if env := opts.environ(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+// The BuildMode counterpart of "go run": build a binary next to tmpfile, run it and
+// delete it. The output is that of go build if it fails, or of the binary otherwise,
+// unless the binary's output is streamed to opts.output. As with go run, a failed
+// run's output ends with the exit status. The time taken by each step is recorded in
+// res, and with opts.CacheDiagnostics, whether the build was cached.
+func buildAndRunBinary(ctx context.Context, tmpfile string, opts Options, res *Result) (out []byte, err error) {
+	binary := strings.TrimSuffix(tmpfile, ".go")
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	if opts.compileTo != "" {
+		binary = opts.compileTo
 	} else {
-		return string(out), ""
+		defer os.Remove(binary)
+	}
+
+	opts.enter(PhaseCompiling)
+	res.phase = PhaseCompiling
+	start := time.Now()
+	if opts.CacheDiagnostics {
+		out, err = command(ctx, opts, opts.goBinary(), opts.goArgs("build", "-x", "-o", binary, tmpfile)...).CombinedOutput()
+		res.CacheHit = err == nil && isCacheHit(out)
+		if err != nil && ctx.Err() == nil {
+			// the errors are buried in the commands that -x prints, so build again without it
+			out, err = command(ctx, opts, opts.goBinary(), opts.goArgs("build", "-o", binary, tmpfile)...).CombinedOutput()
+		}
+	} else {
+		out, err = command(ctx, opts, opts.goBinary(), opts.goArgs("build", "-o", binary, tmpfile)...).CombinedOutput()
+	}
+	res.CompileDuration = time.Since(start)
+	// only the build's output is split, as the program's may look like the go tool's
+	chatter, out := splitToolchainOutput(out)
+	if !opts.CacheDiagnostics { // -x output isn't chatter
+		res.ToolchainOutput = chatter
 	}
-	return "", ""
+	if err != nil {
+		return out, err
+	}
+	if opts.compileTo != "" {
+		return nil, nil
+	}
+
+	cmd := command(ctx, opts, binary)
+	if opts.GoDebug != "" {
+		cmd.Env = append(cmd.Environ(), "GODEBUG="+opts.GoDebug)
+	}
+	profile := ""
+	if opts.Profile != NoProfile {
+		f, err := os.CreateTemp(filepath.Dir(binary), opts.tempPrefix()+"_profile_")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		profile = f.Name()
+		defer os.Remove(profile)
+		cmd.Env = append(cmd.Environ(), "GORE_PROFILE="+profile) // where __profile writes it
+	}
+	coverDir := ""
+	if opts.Coverage {
+		if coverDir, err = os.MkdirTemp(filepath.Dir(binary), opts.tempPrefix()+"_cover_"); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(coverDir)
+		cmd.Env = append(cmd.Environ(), "GOCOVERDIR="+coverDir)
+	}
+	opts.enter(PhaseRunning)
+	res.phase = PhaseRunning
+	start = time.Now()
+	out, err = runCmd(cmd, opts.output, opts)
+	res.RunDuration = time.Since(start)
+	if coverDir != "" && err == nil {
+		if src, e := os.ReadFile(tmpfile); e == nil {
+			res.Coverage, e = lineCoverage(ctx, opts, coverDir, string(src))
+			if e != nil {
+				res.Warnings = append(res.Warnings, "coverage: "+e.Error())
+			}
+		}
+	}
+	if profile != "" {
+		if b, e := os.ReadFile(profile); e == nil && len(b) > 0 {
+			res.Profile = b
+		}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		out = append(out, exitErr.Error()+"\n"...)
+	}
+	return out, err
 }
 
-func save(src string) (tmpfile string) {
-	tmpdir := os.Getenv("TMPDIR")
-	if tmpdir == "" {
-		tmpdir = os.Getenv("TEMPDIR")
+// The phase that a timeout cut a run short in, given the phase it was known to be in,
+// and what it printed. The phase is only known when the code is built into a binary, as
+// "go run" doesn't tell when it's done compiling, but the code must have been running if
+// it printed anything. Otherwise, the phase is unknown ("").
+func timeoutPhase(phase string, printed string) string {
+	if phase == "" && printed != "" {
+		return PhaseRunning
 	}
-	if tmpdir == "" {
-		tmpdir = os.TempDir()
+	return phase
+}
+
+// The error reported for a timeout in phase, so that a slow compile isn't mistaken for
+// code that doesn't terminate
+func timeoutError(phase string, timeout time.Duration) string {
+	switch phase {
+	case PhaseCompiling:
+		return fmt.Sprintf("timeout: compilation exceeded %v", timeout)
+	case PhaseRunning:
+		return fmt.Sprintf("timeout: execution exceeded %v", timeout)
+	}
+	return fmt.Sprintf("timeout: evaluation exceeded %v", timeout)
+}
+
+var compileCmdPat = regexp.MustCompile(`(?m)/compile(?:\.exe)? -o .*$`)
+
+// Given the commands printed by "go build -x", say whether the dependencies of the
+// generated code all came from the build cache. The generated main package itself is
+// always compiled, since its file name differs on every evaluation.
+func isCacheHit(buildOutput []byte) bool {
+	for _, cmd := range compileCmdPat.FindAll(buildOutput, -1) {
+		if !bytes.Contains(cmd, []byte(" -p main ")) {
+			return false
+		}
 	}
-	tmpfile = path.Join(tmpdir, "gore_eval.go")
-	fh, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	return true
+}
+
+var errPat = regexp.MustCompile(`^(\s*):(\d+)(\[.*\])?:(.*)$`)
+
+// an error at a position in a named file, rather than one that a "//line :N" directive
+// maps to the snippet
+var fileErrPat = regexp.MustCompile(`^(\s*)([^\s:\[]\S*?\.go)(:\d+(?::\d+)?:.*)$`)
+
+// Strip the go tool's header from compiler output, and shorten line references
+// of the form ":10[/tmp/gore_eval.go:20]:" to ":10:". An error may continue on
+// indented lines, such as the "have" and "want" of a call with the wrong arguments,
+// or the "other declaration" of a redeclared name, which are kept (indented) after it.
+//
+// The directives map positions in genFile, the generated code, to the snippet's lines,
+// leaving those in the lines gore adds (such as inferred imports) referring to genFile.
+// As its name is random, it is replaced with "<generated>". Errors in any other file
+// (one in the module, say) are passed through as is.
+func formatErrors(out string, genFile string) (err string) {
+	for _, e := range strings.Split(out, "\n") {
+		if e == "" || strings.HasPrefix(e, "# command-line-arguments") {
+			continue
+		}
+		if m := fileErrPat.FindStringSubmatch(e); m != nil && filepath.Base(m[2]) == filepath.Base(genFile) {
+			e = m[1] + "<generated>" + m[3]
+		}
+		err += errPat.ReplaceAllString(e, "$1:$2:$4") + "\n"
+	}
+	return err
+}
+
+// the start of an error (or of an indented line of one) in the snippet, in ":line:" form
+var snippetErrPat = regexp.MustCompile(`(?m)^(\s*):(\d+)`)
+
+// Name the snippet opts.DisplayFilename in errors, as in "snippet.go:3: undefined: x"
+func (opts Options) displayErrors(errs string) string {
+	if opts.DisplayFilename == "" {
+		return errs
+	}
+	return snippetErrPat.ReplaceAllString(errs, "${1}"+strings.Replace(opts.DisplayFilename, "$", "$$", -1)+":$2")
+}
+
+// Run "go vet" on a saved file, and return its findings, one per line, in the same
+// ":line: msg" form as compiler errors. Compile errors, which vet reports as "vet: ...",
+// are left for the compiler to report.
+func vet(ctx context.Context, tmpfile string, opts Options) (warnings []string) {
+	out, _ := command(ctx, opts, opts.goBinary(), "vet", tmpfile).CombinedOutput()
+	vetPat := regexp.MustCompile(`(?m)^(\d+):`) // vet omits the leading ':'
+	out = vetPat.ReplaceAll(out, []byte(":$1:"))
+	for _, w := range strings.Split(formatErrors(string(out), tmpfile), "\n") {
+		if w != "" && !strings.HasPrefix(w, "#") && !strings.HasPrefix(w, "vet: ") {
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings
+}
+
+// The directory to save generated code in, along with a func that removes it if it was
+// created for the purpose: with opts.ModuleDir, a temporary subdirectory of the module
+func genDir(opts Options) (dir string, cleanup func()) {
+	if opts.ModuleDir == "" {
+		return "", func() {} // any of the tempDirs, see save
+	}
+	dir, err := os.MkdirTemp(opts.ModuleDir, "."+opts.tempPrefix()) // the leading '.' hides it from "./..."
 	if err != nil {
-		panic("Unable to open file: '" + tmpfile + "': " + err.Error())
+		panic("Unable to create temp dir in module: " + err.Error())
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// path made absolute, if it can be; "" is left alone
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// The file operations behind tempDirs and save; tests replace them to simulate
+// unset variables and unwritable directories
+var (
+	getenv     = os.Getenv
+	osTempDir  = os.TempDir
+	createTemp = os.CreateTemp
+)
+
+// The directories temp files may go in, in order of preference: $TMPDIR, $TEMPDIR,
+// and the OS default. Unset variables are skipped, as are repeats.
+func tempDirs() []string {
+	var dirs []string
+	seen := map[string]bool{"": true}
+	for _, dir := range []string{getenv("TMPDIR"), getenv("TEMPDIR"), osTempDir()} {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
 	}
-	fh.WriteString(src)
-	fh.Close()
-	return tmpfile
+	return dirs
 }
 
-func buildMain(topLevel string, nonTopLevel string, pkgsToImport map[string]bool) string {
+func tempDir() (tmpdir string) {
+	return tempDirs()[0]
+}
+
+// Create a file named after pattern (see os.CreateTemp) in the first of the tempDirs
+// that allows it. The error, if none does, is the one for the first.
+func createInTempDir(pattern string) (*os.File, error) {
+	var firstErr error
+	for _, dir := range tempDirs() {
+		fh, err := createTemp(dir, pattern)
+		if err == nil {
+			return fh, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// Write src to a new file in dir, named prefix_<random>.go, so that concurrent
+// evaluations don't overwrite each other's code. If dir is "", the file goes in the
+// first of the tempDirs that's writable.
+func save(dir string, prefix string, src string) (tmpfile string) {
+	var fh *os.File
+	var err error
+	if dir == "" {
+		fh, err = createInTempDir(prefix + "_*.go")
+	} else {
+		fh, err = createTemp(dir, prefix+"_*.go")
+	}
+	if err != nil {
+		panic("Unable to create temp file: " + err.Error())
+	}
+	_, err = fh.WriteString(src)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		panic("Unable to write '" + fh.Name() + "': " + err.Error())
+	}
+	return fh.Name()
+}
+
+func buildMain(topLevel string, nonTopLevel string, pkgsToImport map[string]string) string {
+	// sorted, so that the same snippet always generates the same code
+	paths := make([]string, 0, len(pkgsToImport))
+	for k := range pkgsToImport {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
 	imports := ""
-	for k, _ := range pkgsToImport {
-		imports += `import "` + k + "\"\n"
+	for _, k := range paths {
+		name := pkgsToImport[k]
+		if name == path.Base(k) {
+			imports += fmt.Sprintf("import %q\n", k)
+		} else { // inferred from Options.Imports under a different name
+			imports += fmt.Sprintf("import %s %q\n", name, k)
+		}
 	}
 	template := `
 package main
@@ -421,21 +1885,153 @@ package main
 func main() {
 %s
 }
+`
+	helpers := ""
+	imported := make(map[string]bool)
+	for _, h := range optionalHelpers {
+		used := strings.Contains(topLevel, h.name+"(") || strings.Contains(nonTopLevel, h.name+"(")
+		if !used || strings.Contains(topLevel, "func "+h.name+"(") { // unused, or the snippet has its own
+			continue
+		}
+		for _, imp := range h.imports {
+			if !imported[imp] {
+				imported[imp] = true
+				imports += imp + "\n"
+			}
+		}
+		helpers += h.src
+	}
+	return fmt.Sprintf(template, imports, topLevel, nonTopLevel) + helpers
+}
 
+// Helpers for the aliases, added to the generated code only if used, along with their
+// imports. These are named so as not to clash with the snippet's; in particular, fmt is
+// imported for the snippet only if it uses it (or explicitly imports it).
+var optionalHelpers = []struct {
+	name    string
+	imports []string
+	src     string
+}{
+	{"__p", []string{`import __fmt "fmt"`}, `
 func __p(values ...interface{}){
 	for _, v := range values {
-             fmt.Printf(%s, v)
+             __fmt.Printf("%+v\n", v)
 	}
 }
+`},
+	{"__t", []string{`import __fmt "fmt"`}, `
 func __t(values ...interface{}){
 	for _, v := range values {
-             fmt.Printf(%s, v)
+             __fmt.Printf("%T\n", v)
 	}
 }
-`
-	valueFmt := `"%+v\n"` // Embedding %v into template expands it prematurely!
-	typeFmt := `"%T\n"`
-	return fmt.Sprintf(template, imports, topLevel, nonTopLevel, valueFmt, typeFmt)
+`},
+	{"__e", []string{`import __fmt "fmt"`, `import __os "os"`}, `
+func __e(values ...interface{}){
+	for _, v := range values {
+             __fmt.Fprintf(__os.Stderr, "%+v\n", v)
+	}
+}
+`},
+	{"__pr", []string{`import __fmt "fmt"`}, `
+func __pr(values ...interface{}){
+	__fmt.Print(values...)
+}
+`},
+	{"__pj", []string{`import __fmt "fmt"`, `import __json "encoding/json"`}, `
+func __pj(values ...interface{}){
+	for _, v := range values {
+		if b, err := __json.MarshalIndent(v, "", "  "); err == nil {
+			__fmt.Printf("%s\n", b)
+		} else {
+			__fmt.Printf("%+v\n", v)
+		}
+	}
+}
+`},
+	{"__pt", []string{`import __fmt "fmt"`, `import __os "os"`, `import __reflect "reflect"`, `import __tabwriter "text/tabwriter"`}, `
+func __pt(values ...interface{}){
+	for _, v := range values {
+		rv := __reflect.ValueOf(v)
+		if k := rv.Kind(); (k != __reflect.Slice && k != __reflect.Array) || rv.Type().Elem().Kind() != __reflect.Struct {
+			__fmt.Printf("%+v\n", v)
+			continue
+		}
+		w := __tabwriter.NewWriter(__os.Stdout, 0, 0, 2, ' ', 0)
+		typ := rv.Type().Elem()
+		for i := 0; i < typ.NumField(); i++ {
+			if i > 0 {
+				__fmt.Fprint(w, "\t")
+			}
+			__fmt.Fprint(w, typ.Field(i).Name)
+		}
+		__fmt.Fprintln(w)
+		for r := 0; r < rv.Len(); r++ {
+			for i := 0; i < typ.NumField(); i++ {
+				if i > 0 {
+					__fmt.Fprint(w, "\t")
+				}
+				__fmt.Fprintf(w, "%+v", rv.Index(r).Field(i))
+			}
+			__fmt.Fprintln(w)
+		}
+		w.Flush()
+	}
+}
+`},
+	{"__ph", []string{`import __fmt "fmt"`, `import __hex "encoding/hex"`, `import __reflect "reflect"`}, `
+func __ph(values ...interface{}){
+	for _, v := range values {
+		rv := __reflect.ValueOf(v)
+		if k := rv.Kind(); (k != __reflect.Slice && k != __reflect.Array) || rv.Type().Elem().Kind() != __reflect.Uint8 {
+			__fmt.Printf("%+v\n", v)
+			continue
+		}
+		b := make([]byte, rv.Len())
+		__reflect.Copy(__reflect.ValueOf(b), rv)
+		__fmt.Println(__hex.EncodeToString(b))
+	}
+}
+`},
+	{"__profile", []string{`import __os "os"`, `import __runtime "runtime"`, `import __pprof "runtime/pprof"`}, `
+func __profile(kind string) (stop func()) {
+	f, err := __os.Create(__os.Getenv("GORE_PROFILE"))
+	if err != nil {
+		return func() {}
+	}
+	if kind == "cpu" {
+		if __pprof.StartCPUProfile(f) != nil {
+			return func() { f.Close() }
+		}
+		return func() { __pprof.StopCPUProfile(); f.Close() }
+	}
+	return func() { __runtime.GC(); __pprof.WriteHeapProfile(f); f.Close() }
+}
+`},
+	{"__catch", []string{`import __fmt "fmt"`, `import __os "os"`, `import __runtime "runtime"`}, `
+func __catch() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	// The innermost frame in the snippet's code, whose lines have no file name
+	pcs := make([]uintptr, 64)
+	frames := __runtime.CallersFrames(pcs[:__runtime.Callers(2, pcs)])
+	line := 0
+	for more := true; more && line == 0; {
+		var f __runtime.Frame
+		f, more = frames.Next()
+		if f.File == "" || f.File == "??" {
+			line = f.Line
+		}
+	}
+	__fmt.Fprintf(__os.Stderr, "panic: %v\n", r)
+	if line > 0 {
+		__fmt.Fprintf(__os.Stderr, "\tat line %d\n", line)
+	}
+	__os.Exit(2)
+}
+`},
 }
 
 // Functions for converting the input string into a series of chunks.
@@ -512,6 +2108,8 @@ func readMultilineComment(mark int, scanner *Scanner) (chunk Chunk, err error) {
 	return
 }
 
+var errNewlineInString = errors.New("newline in string")
+
 func readString(mark int, scanner *Scanner, endCh rune) (chunk Chunk, err error) {
 	// Looking for endCh (single or double quote) while taking care of escapes
 	for {
@@ -524,7 +2122,7 @@ func readString(mark int, scanner *Scanner, endCh rune) (chunk Chunk, err error)
 		} else if ch == '\\' {
 			scanner.ReadRune() // read past next char
 		} else if ch == '\n' {
-			panic("Newline in string @ " + string(scanner.Pos()))
+			return chunk, errNewlineInString
 		}
 	}
 	return // dummy
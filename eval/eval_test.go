@@ -1,10 +1,21 @@
 package eval_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/sriram-srinivasan/gore/eval"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestSimple(t *testing.T) {
@@ -51,6 +62,12 @@ func TestMultilineError(t *testing.T) {
 	check(t, code, "", ":3: cannot refer to unexported name math.log")
 }
 
+// errors that continue on indented lines keep them, with their line references shortened too
+func TestMultilineDiagnostics(t *testing.T) {
+	check(t, "func f(x int) {}\nf()", "", ":2: not enough arguments in call to f\n\thave ()\n\twant (int)\n")
+	check(t, "x := 1\nvar x = 2\np x", "", ":2: x redeclared in this block\n\t:1: other declaration of x\n")
+}
+
 func TestImportRepair(t *testing.T) {
 	// Using a var name ('math' here) that is identical to a standard package name. Eval should
 	// import the "math" package and retry if the compiler complains about duplicate packages
@@ -64,6 +81,42 @@ func TestImportRepair(t *testing.T) {
 	check(t, code, "100", "")
 }
 
+// constants, variables and funcs used without a call are inferred, whatever precedes them
+func TestSelectorInference(t *testing.T) {
+	tests := []struct{ code, out string }{
+		{"p http.StatusOK", "200"},
+		{"p len(os.Args) > 0", "true"},
+		{"p math.Pi > 3", "true"},
+		{"p time.Second", "1s"},
+		{"f := unicode.IsLetter; p f('a')", "true"},
+		{"p -math.Pi < 0, !unicode.IsLetter('1')", "true\ntrue"},
+		{"p [2]int{http.StatusOK}[0], map[string]time.Duration{\"s\": time.Second}", "200\nmap[s:1s]"},
+		{"d := 2*time.Second+time.Second/2; p d", "2.5s"},
+		{"p 1+(http.StatusOK), []string{os.Args[0]}[0] != \"\"", "201\ntrue"},
+		{"var c int = http.StatusOK; p c", "200"},
+		{"args := &os.Args; p len(*args) > 0", "true"},
+		{"p math.Pi*2 > 6, math.MaxInt8", "true\n127"},
+		{"if x := http.StatusOK; x == 200 { p \"ok\" }", "ok"},
+		{"p strings.Map(func(r rune) rune { if unicode.IsLetter(r) { return r }; return -1 }, \"a1b\")", "ab"},
+	}
+	for _, test := range tests {
+		check(t, test.code, test.out, "")
+	}
+}
+
+// packages that inference misses are imported once the compiler finds them undefined
+func TestUndefinedImportRepair(t *testing.T) {
+	code := "var b bytes .Buffer\nb.WriteString(strings .ToUpper(\"gore\"))\np b.String()"
+	_, _, pkgsToImport, _, _ := eval.Partition(code, eval.BuiltinPkgs())
+	if len(pkgsToImport) != 0 {
+		t.Fatalf("Expected inference to miss the packages. Instead got %v", pkgsToImport)
+	}
+	check(t, code, "GORE", "")
+
+	// an undefined variable that happens to be named like a package stays undefined
+	check(t, "p sort", "", ":1: undefined: sort")
+}
+
 func TestAliases(t *testing.T) {
 	// Ensure that using p and t as variables or as function names doesn't incorrectly expand them
 	code := `
@@ -78,6 +131,38 @@ func TestAliases(t *testing.T) {
 	check(t, code, "10\nint\n", "")
 }
 
+// aliases after a ';' are expanded too, but not when the ';' is inside a string
+func TestAliasesAfterSemicolon(t *testing.T) {
+	code := `x := 1; y := "a; p b"; p x; t y`
+	check(t, code, "1\nstring", "")
+}
+
+// a loop variable named like an alias isn't expanded in the clauses of a for, nor is a
+// statement that continues an expression with a binary operator
+func TestLoopVarNamedLikeAlias(t *testing.T) {
+	check(t, "for p := 0; p < 3; p++ { fmt.Println(p) }", "0\n1\n2", "")
+	check(t, "for t := 0; t < 2; t++ {\n  p t\n}", "0\n1", "")
+	check(t, "x := 0; for e := 3; e > 0; e-- { x += e }; p x", "6", "")
+	check(t, "if p := 2; p > 1 { p p }", "2", "")
+	check(t, "switch t := 1; t {\ncase 1:\n  p \"one\"\n}", "one", "")
+	check(t, "p := 3\np * 2", "", ":2: p * 2 (value of type int) is not used\n")
+}
+
+// an alias's arguments may start with a unary operator
+func TestAliasUnaryArgs(t *testing.T) {
+	check(t, "p -1", "-1", "")
+	check(t, "x := 5; ptr := &x; p *ptr", "5", "")
+	check(t, "ch := make(chan int, 1); ch <- 7; p <-ch", "7", "")
+	check(t, "type T struct{ A int }\np &T{1}", "&{A:1}", "")
+	check(t, "p ^0, !true, +2", "-1\nfalse\n2", "")
+}
+
+// aliases may be separated from their arguments by tabs
+func TestAliasesWithTabs(t *testing.T) {
+	code := "x := 42\np\tx\nt \t x\n\tp\t\"indented\""
+	check(t, code, "42\nint\nindented", "")
+}
+
 func TestPartitioning(t *testing.T) {
 	code := `
           p "TestPartitioning"
@@ -97,6 +182,191 @@ func TestPartitioning(t *testing.T) {
 	check(t, code, "TestPartitioning\nbar\ntrue\n{a:10 b:true}", "")
 }
 
+// the min, max and clear builtins of go 1.21 need no imports, and work with the aliases
+func TestMinMaxClear(t *testing.T) {
+	code := `
+        x := []int{4, 2, 8}
+        p max(1, 2, 3), min(x[0], x[1], x[2])
+        t max(1.5, 2)
+        m := map[string]int{"a": 1, "b": 2}
+        clear(m)
+        p len(m)
+        clear(x); p x
+        `
+	_, _, pkgsToImport, warnings, err := eval.Partition(code, eval.BuiltinPkgs())
+	if err != nil || len(pkgsToImport) != 0 || len(warnings) != 0 {
+		t.Errorf("Expected no imports or warnings. Instead got %v, %q, err %v", pkgsToImport, warnings, err)
+	}
+	check(t, code, "3\n2\nfloat64\n0\n[0 0 0]", "")
+
+	// min and max aren't variadic, and the compiler says so
+	check(t, "x := []int{1}\np min(x...)", "", ":2: invalid operation: invalid use of ... with built-in min")
+}
+
+// declarations nested in a func or method declaration stay in its body, rather than
+// being hoisted on their own; hoisted, the Local types would be redeclared
+func TestNestedDeclarations(t *testing.T) {
+	code := `
+          func helper() string {
+              type Local struct{ a int }
+              const c = 1
+              var v = Local{c}
+              return fmt.Sprint(v)
+          }
+          type T struct{}
+          func (T) method() string {
+              type Local struct{ b string }
+              var (
+                  v = Local{"m"}
+              )
+              const (
+                  d = 2
+              )
+              return fmt.Sprint(v, d)
+          }
+          type Local int
+          const c = 3
+          p helper(), T{}.method(), Local(c)
+         `
+	topLevel, nonTopLevel, _, _, err := eval.Partition(code, eval.BuiltinPkgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"struct{ a int }", "const c = 1", "var v = Local{c}", "struct{ b string }", `v = Local{"m"}`, "d = 2"} {
+		if !strings.Contains(topLevel, s) || strings.Contains(nonTopLevel, s) {
+			t.Errorf("Expected %q in the func body. Instead got top level:\n%s\nmain:\n%s", s, topLevel, nonTopLevel)
+		}
+	}
+	check(t, code, "{1}\n{m} 2\n3", "")
+}
+
+// func literals stay in main, wherever they are assigned or called; only func
+// declarations are hoisted
+func TestFuncLiteralPartitioning(t *testing.T) {
+	code := `
+          f := func(x int) int { return x * 2 }
+          g := func() {
+              p "in g"
+          }
+          func bar() int { return 3 }
+          func baz() {
+              p "in baz"
+          }
+          defer func() {
+              p "deferred"
+          }()
+          var h = func() int { return bar() }
+          g()
+          baz()
+          p f(h())
+         `
+	topLevel, nonTopLevel, _, _, err := eval.Partition(code, eval.BuiltinPkgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"func bar()", "func baz()", `p "in baz"`} {
+		if !strings.Contains(topLevel, s) || strings.Contains(nonTopLevel, s) {
+			t.Errorf("Expected %q at top level. Instead got top level:\n%s\nmain:\n%s", s, topLevel, nonTopLevel)
+		}
+	}
+	for _, s := range []string{"f := func", "g := func", `p "in g"`, "defer func", `p "deferred"`, "var h = func"} {
+		if !strings.Contains(nonTopLevel, s) || strings.Contains(topLevel, s) {
+			t.Errorf("Expected %q in main. Instead got top level:\n%s\nmain:\n%s", s, topLevel, nonTopLevel)
+		}
+	}
+	check(t, code, "in g\nin baz\n6\ndeferred", "")
+}
+
+// top-level funcs can refer to each other, and to those declared after them, and keep
+// their own line numbers
+func TestMutuallyRecursiveFuncs(t *testing.T) {
+	code := `func isEven(n int) bool {
+	if n == 0 {
+		return true
+	}
+	return isOdd(n - 1)
+}
+p isEven(10), describe(7)
+func isOdd(n int) bool {
+	if n == 0 {
+		return false
+	}
+	return isEven(n - 1)
+}
+func describe(n int) string {
+	return fmt.Sprint(n, " odd: ", isOdd(n))
+}`
+	check(t, code, "true\n7 odd: true", "")
+
+	topLevel, _, _, _, err := eval.Partition(code, eval.BuiltinPkgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range []string{"//line :1\nfunc isEven(", "//line :8\nfunc isOdd(", "//line :14\nfunc describe("} {
+		if !strings.Contains(topLevel, decl) {
+			t.Errorf("Expected %q at the top level. Instead got:\n%s", decl, topLevel)
+		}
+	}
+	// an error in each func is reported on its own line
+	broken := strings.Replace(strings.Replace(code, "return isOdd(n - 1)", "return isOdd(n - x)", 1), "n, \" odd", "y, \" odd", 1)
+	check(t, broken, "", ":5: undefined: x\n:15: undefined: y\n")
+}
+
+// a snippet ending without a newline, in a closing brace or otherwise, is partitioned
+// without losing or duplicating anything
+func TestPartitionAtEOF(t *testing.T) {
+	tests := []struct{ code, out string }{
+		{"func f() int {\n  return 1\n}\np f()", "1"},
+		{"p f()\nfunc f() int {\n  return 2\n}", "2"},
+		{"p g()\nfunc g() int { return 3 }", "3"},
+		{"if true {\n  p 4\n}", "4"},
+		{"type T struct {\n  a int\n}\np T{5}", "{a:5}"},
+		{"p 6 /* a comment */", "6"},
+		{"p 7\n// a comment", "7"},
+		{"p `8`", "8"},
+		{"p \"9\"", "9"},
+	}
+	for _, test := range tests {
+		topLevel, nonTopLevel, _, _, err := eval.Partition(test.code, eval.BuiltinPkgs())
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.code, err)
+			continue
+		}
+		var lines []string
+		for _, l := range strings.Split(topLevel+"\n"+nonTopLevel, "\n") {
+			if l != "" && !strings.HasPrefix(l, "//line ") {
+				lines = append(lines, l)
+			}
+		}
+		original := strings.Split(test.code, "\n")
+		sort.Strings(lines)
+		sort.Strings(original)
+		if strings.Join(lines, "\n") != strings.Join(original, "\n") {
+			t.Errorf("%q: Expected the same lines after partitioning. Instead got top level %q, main %q", test.code, topLevel, nonTopLevel)
+		}
+		check(t, test.code, test.out, "")
+	}
+}
+
+// a long minified line is partitioned as one, in linear time
+func TestLongLine(t *testing.T) {
+	body := strings.Repeat("if x >= 0 { x++ }; ", 50000) // ~1MB
+	code := "func count() (x int) { " + body + "return x }\np count(); " + body
+
+	start := time.Now()
+	topLevel, nonTopLevel, _, _, err := eval.Partition(code, eval.BuiltinPkgs())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Partitioning took %v", elapsed)
+	}
+	if err != nil || !strings.HasPrefix(ts(topLevel), "//line :1") || !strings.Contains(topLevel, "return x }") ||
+		!strings.Contains(nonTopLevel, "p count();") {
+		t.Fatalf("Expected the func on line 1 at top level and the rest in main. Instead got err %v", err)
+	}
+
+	code = "func count() (x int) { " + body[:1900] + "return x }\np count()"
+	check(t, code, "100", "")
+}
+
 func TestStrings(t *testing.T) {
 	// Inside a double quoted string, it should be ok to have:
 	//   1. expressions of the form abc.foo, where abc is not mistakenly interpreted to be a package name
@@ -117,6 +387,31 @@ string /**/`
 	check(t, code, out, "")
 }
 
+// the arguments of an alias can span lines, up to the one that closes their brackets
+func TestMultilineAliasArgs(t *testing.T) {
+	check(t, "p strings.Repeat(\n  \"ab\",\n  2)", "abab", "")
+	check(t, "p strings.Join([]string{\n  \"a\", // first\n  \"b)\",\n}, \"-\") // joined\np 2", "a-b)\n2", "")
+	check(t, "t struct{\n  x int\n}{1}, fmt.Sprint(\n  1,\n  2)", "struct { x int }\nstring", "")
+	check(t, "x := 1\np fmt.Sprint(x,\n  \"a\"); p \"b\"", "1a\nb", "")
+	// a block opened by a later statement on the line isn't the alias's
+	check(t, "x := 1\np x; if x > 0 {\n  p 2\n}", "1\n2", "")
+	check(t, "p 0; for i := 1; i < 3; i++ {\n  p i\n}", "0\n1\n2", "")
+	check(t, "p fmt.Sprint(1,\n  2); if true {\n  p 3\n}", "1 2\n3", "")
+	// lines keep their numbers, for errors after the alias and in its arguments
+	check(t, "p strings.Repeat(\n  \"ab\",\n  2)\np y", "", ":4: undefined: y\n")
+	check(t, "p fmt.Sprint(\n  1,\n  y,\n)", "", ":3: undefined: y\n")
+}
+
+// the lines of a multi-line raw string are kept exactly, even if they look like aliases
+func TestMultilineRawString(t *testing.T) {
+	raw := "first\n\n  p not an alias\n// not a comment {\nerr := \"nor a statement\"\n  last"
+	code := "s := `" + raw + "`; p len(s)\nfmt.Printf(\"%q\\n\", s)\nx := `a\n`+`b`; p x"
+	out, err := eval.EvalWithOptions(code, eval.Options{AutoCheckErr: true})
+	if want := fmt.Sprintf("%d\n%q\na\nb\n", len(raw), raw); out != want || err != "" {
+		t.Errorf("Expected %q. Instead got %q, err %q", want, out, err)
+	}
+}
+
 // checks that comment chars inside strings are ignored, and that leading and trailing comments don't confuse paren/bracket accounting
 func TestComments(t *testing.T) {
 	code := `
@@ -145,7 +440,1857 @@ func TestCommentsErr(t *testing.T) {
 	check(t, code, "", ":4: undefined: xxx")
 }
 
-var ts = strings.TrimSpace
+// braces in comments don't count towards closing a declaration's block
+func TestBracesInComments(t *testing.T) {
+	tests := []struct{ code, out string }{
+		{"func f() { // }\n  p 1 }\nf()", "1"},
+		{"func f() { /* } { */\n  p 2\n}\nf()", "2"},
+		{"func f() {\n  /*\n}\n*/ fmt.Println(3)\n}\nf()", "3"},
+		{"type T struct { // {\n  x int /* } */ }\np T{4}", "{x:4}"},
+		{"if true { // {\n  p 5 }", "5"},
+	}
+	for _, test := range tests {
+		topLevel, nonTopLevel, _, _, err := eval.Partition(test.code, eval.BuiltinPkgs())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(nonTopLevel, "func f") || strings.Contains(nonTopLevel, "type T") || strings.Contains(topLevel, "f()\n") {
+			t.Errorf("%q: Expected the declaration, and only it, at the top level. Instead got:\n%s\n--\n%s", test.code, topLevel, nonTopLevel)
+		}
+		check(t, test.code, test.out, "")
+	}
+	// line numbers are kept after a multi-line comment
+	check(t, "func f() {\n  /* }\n  } */\n  p x\n}", "", ":4: undefined: x\n")
+}
+
+// an infinite loop must be killed once the timeout expires
+func TestTimeout(t *testing.T) {
+	start := time.Now()
+	out, err := eval.EvalWithOptions("for {}", eval.Options{Timeout: 200 * time.Millisecond})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected eval to return promptly after the timeout. Took %v", elapsed)
+	}
+	if out != "" || !strings.HasPrefix(err, "timeout:") {
+		t.Errorf("Expected a timeout error. Instead got out: %q, err: %q", out, err)
+	}
+}
+
+// vet findings are reported as warnings, without stopping the snippet from running
+func TestVet(t *testing.T) {
+	code := `fmt.Printf("%d\n", "string")`
+	res := eval.EvalResult(code, eval.Options{Vet: true})
+	if res.Err != "" || !strings.Contains(res.Out, "%!d(string=string)") {
+		t.Errorf("Expected snippet to run. Instead got out: %q, err: %q", res.Out, res.Err)
+	}
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], ":1: fmt.Printf format %d has arg") {
+		t.Errorf("Expected a vet warning for line 1. Instead got: %q", res.Warnings)
+	}
+
+	res = eval.EvalResult(code, eval.Options{Vet: true, SuppressCompileOutput: true})
+	if len(res.Warnings) != 0 || res.Out == "" {
+		t.Errorf("Expected only the run output. Instead got out: %q, warnings: %q", res.Out, res.Warnings)
+	}
+	res = eval.EvalResult(code, eval.Options{Vet: true, SuppressRunOutput: true})
+	if len(res.Warnings) != 1 || res.Out != "" {
+		t.Errorf("Expected only the vet warning. Instead got out: %q, warnings: %q", res.Out, res.Warnings)
+	}
+}
+
+// with VetAsError, vet's findings stop the code from running
+func TestVetAsError(t *testing.T) {
+	code := "p \"ran\"\nfmt.Printf(\"%d\\n\", \"string\")"
+	out, err := eval.EvalWithOptions(code, eval.Options{VetAsError: true})
+	if out != "" || !strings.HasPrefix(err, ":2: fmt.Printf format %d has arg") {
+		t.Errorf("Expected vet's finding as the error. Instead got out %q, err %q", out, err)
+	}
+	out, err = eval.EvalWithOptions(code, eval.Options{VetAsError: true, SuppressCompileOutput: true})
+	if out != "" || err != "compilation failed" {
+		t.Errorf("Expected vet's finding to be suppressed. Instead got out %q, err %q", out, err)
+	}
+
+	// compile errors are still the compiler's, and clean code runs
+	out, err = eval.EvalWithOptions("p x", eval.Options{VetAsError: true})
+	if err != ":1: undefined: x\n" {
+		t.Errorf("Expected the compile error. Instead got out %q, err %q", out, err)
+	}
+	out, err = eval.EvalWithOptions(`p "clean"`, eval.Options{VetAsError: true})
+	if out != "clean\n" || err != "" {
+		t.Errorf("Expected the code to run. Instead got out %q, err %q", out, err)
+	}
+}
+
+func TestSuppressCompileOutput(t *testing.T) {
+	res := eval.EvalResult(`mt.Println("gore test")`, eval.Options{SuppressCompileOutput: true})
+	if res.Err != "compilation failed" {
+		t.Errorf("Expected compiler errors to be suppressed. Instead got: %q", res.Err)
+	}
+}
+
+// both exec modes give the same output, errors and remapped panic line numbers
+func TestExecModes(t *testing.T) {
+	tests := []struct{ code, out, err string }{
+		{`p "hello"`, "hello", ""},
+		{`mt.Println("gore test")`, "", ":1: undefined: mt"},
+		{"a := []int{}\np \"crash\"\np a[3]", "", "\t??:3 "},
+	}
+	for _, mode := range []eval.ExecMode{eval.RunMode, eval.BuildMode} {
+		for _, test := range tests {
+			out, err := eval.EvalWithOptions(test.code, eval.Options{ExecMode: mode})
+			if !strings.Contains(out, test.out) || !strings.Contains(err, test.err) {
+				t.Errorf("Mode %d: Expected out %q, err %q. Instead got out %q, err %q", mode, test.out, test.err, out, err)
+			}
+		}
+	}
+	_, err := eval.EvalWithOptions("os.Exit(3)", eval.Options{ExecMode: eval.BuildMode})
+	if !strings.Contains(err, "exit status 3") {
+		t.Errorf("Expected the binary's exit status to be reported. Instead got %q", err)
+	}
+}
+
+// a panic is summed up in Result.Panic, with the line of the snippet that panicked
+func TestPanicInfo(t *testing.T) {
+	code := "a := []int{}\np 1\nfunc get(a []int, i int) int {\n  return a[i]\n}\np get(a, 3)"
+	want := eval.PanicInfo{Message: "runtime error: index out of range [3] with length 0", Goroutine: 1, Line: 4}
+	for _, mode := range []eval.ExecMode{eval.RunMode, eval.BuildMode} {
+		if res := eval.EvalResult(code, eval.Options{ExecMode: mode}); res.Panic == nil || *res.Panic != want || res.Out != "1\n" {
+			t.Errorf("Mode %d: Expected %+v. Instead got %+v", mode, want, res.Panic)
+		}
+	}
+	tests := []struct {
+		code string
+		opts eval.Options
+		want eval.PanicInfo
+	}{
+		{code, eval.Options{CatchPanics: true}, eval.PanicInfo{Message: want.Message, Line: 4}},
+		{"var m map[int]int\nm[1] = 2", eval.Options{}, eval.PanicInfo{Message: "assignment to entry in nil map", Goroutine: 1, Line: 2}},
+		{"panic(errors.New(\"two\\nlines\"))", eval.Options{}, eval.PanicInfo{Message: "two\nlines", Goroutine: 1, Line: 1}},
+		{"var p *struct{ x int }\nfmt.Println(p.x)", eval.Options{}, eval.PanicInfo{Message: "runtime error: invalid memory address or nil pointer dereference", Goroutine: 1, Line: 2}},
+	}
+	for _, test := range tests {
+		if res := eval.EvalResult(test.code, test.opts); res.Panic == nil || *res.Panic != test.want {
+			t.Errorf("%q: Expected %+v. Instead got %+v from %q", test.code, test.want, res.Panic, res.Err)
+		}
+	}
+	for _, code := range []string{"os.Exit(3)", "p 1", "p x", "select {}"} {
+		if res := eval.EvalResult(code, eval.Options{}); res.Panic != nil {
+			t.Errorf("%q: Expected no panic. Instead got %+v", code, res.Panic)
+		}
+	}
+}
+
+// CatchPanics reports a panic with the snippet's line instead of the goroutine trace
+func TestCatchPanics(t *testing.T) {
+	code := "a := []int{}\np \"crash\"\nfunc get(a []int, i int) int {\n  return a[i]\n}\np get(a, 3)"
+	_, uncaught := eval.Eval(code)
+	if !strings.Contains(uncaught, "goroutine 1") || !strings.Contains(uncaught, "\t??:4\n") {
+		t.Errorf("Expected the full trace. Instead got %q", uncaught)
+	}
+	for _, mode := range []eval.ExecMode{eval.RunMode, eval.BuildMode} {
+		out, err := eval.EvalWithOptions(code, eval.Options{CatchPanics: true, ExecMode: mode})
+		want := "panic: runtime error: index out of range [3] with length 0\n\tat line 4\nexit status 2\n"
+		if out != "crash\n" || err != want {
+			t.Errorf("Mode %d: Expected out \"crash\\n\", err %q. Instead got out %q, err %q", mode, want, out, err)
+		}
+	}
+	tests := []struct{ code, out, err string }{
+		{"defer fmt.Println(\"deferred\")\npanic(errors.New(\"boom\"))", "deferred\n", "panic: boom\n\tat line 2\n"},
+		{"defer func() { recover() }()\npanic(1)\np \"unreachable\"", "", ""}, // recovered by the snippet itself
+		{"p 1", "1\n", ""},
+	}
+	for _, test := range tests {
+		out, err := eval.EvalWithOptions(test.code, eval.Options{CatchPanics: true})
+		if out != test.out || !strings.HasPrefix(err, test.err) || (test.err == "") != (err == "") {
+			t.Errorf("%q: Expected out %q, err %q. Instead got out %q, err %q", test.code, test.out, test.err, out, err)
+		}
+	}
+}
+
+// a package-like name with no known import is flagged, but locals and explicit imports aren't
+func TestUnresolvedPackageWarning(t *testing.T) {
+	code := `
+        import "regexp"
+        pt := struct{ x int }{10}
+        func show(s fmt.Stringer) string { return s.String() }
+        p pt.x, regexp.QuoteMeta(".")
+        fmtt.Println("typo")
+        `
+	res := eval.EvalResult(code, eval.Options{})
+	expected := []string{"no import known for `fmtt` (line 6); import it explicitly"}
+	if fmt.Sprint(res.Warnings) != fmt.Sprint(expected) {
+		t.Errorf("Expected warnings %q. Instead got %q", expected, res.Warnings)
+	}
+	if !strings.Contains(res.Err, ":6: undefined: fmtt") {
+		t.Errorf("Expected a compiler error for line 6. Instead got %q", res.Err)
+	}
+}
+
+// snippets run within a module can import its packages
+func TestModuleDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("go.mod", "module example.com/scratch\n\ngo 1.16\n")
+	write("greet/greet.go", "package greet\n\nfunc Hello() string { return \"hello from module\" }\n")
+
+	code := `
+        import "example.com/scratch/greet"
+        p greet.Hello()
+        `
+	out, err := eval.EvalWithOptions(code, eval.Options{ModuleDir: dir})
+	if err != "" || ts(out) != "hello from module" {
+		t.Errorf("Expected the module's package to be usable. Instead got out: %q, err: %q", out, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("Expected the temp dir in the module to be removed. Found %v", entries)
+	}
+
+	// a ModuleDir relative to the working directory, for evaluations and sessions
+	t.Chdir(filepath.Dir(dir))
+	rel := eval.Options{ModuleDir: filepath.Base(dir)}
+	if out, err := eval.EvalWithOptions(code, rel); err != "" || ts(out) != "hello from module" {
+		t.Errorf("Expected a relative ModuleDir to work. Instead got out: %q, err: %q", out, err)
+	}
+	s := eval.NewSession(func(o *eval.Options) { *o = rel })
+	if out, err := s.Eval(code); err != "" || ts(out) != "hello from module" {
+		t.Errorf("Expected a relative ModuleDir to work in a session. Instead got out: %q, err: %q", out, err)
+	}
+	s.Close()
+
+	write("go.mod", "module example.com/scratch\n\ngo 1.999\n")
+	_, err = eval.EvalWithOptions(code, eval.Options{ModuleDir: dir})
+	if !strings.Contains(err, "requires go >= 1.999, but the installed toolchain is go ") {
+		t.Errorf("Expected a toolchain version error. Instead got %q", err)
+	}
+}
+
+func TestFunctionalOptions(t *testing.T) {
+	// with no options, Eval behaves as it always has
+	check(t, `p "no options"`, "no options", "")
+
+	out, err := eval.Eval("for {}", eval.WithTimeout(200*time.Millisecond))
+	if out != "" || !strings.HasPrefix(err, "timeout:") {
+		t.Errorf("Expected a timeout error. Instead got out: %q, err: %q", out, err)
+	}
+
+	_, err = eval.Eval(`p "hi"`, eval.WithGoBinary("/no/such/go"))
+	if !strings.Contains(err, "/no/such/go") {
+		t.Errorf("Expected an error running the missing go binary. Instead got %q", err)
+	}
+
+	// "str" is inferred to be "strings"
+	out, err = eval.Eval(`p str.ToUpper("abc")`, eval.WithImports(map[string]string{"str": "strings"}))
+	if ts(out) != "ABC" || err != "" {
+		t.Errorf("Expected str to be imported as strings. Instead got out: %q, err: %q", out, err)
+	}
+	// a standard package can be overridden
+	_, err = eval.Eval(`p math.MaxInt32`, eval.WithImports(map[string]string{"math": "math/big"}))
+	if !strings.Contains(err, ":1: undefined: math.MaxInt32") {
+		t.Errorf("Expected math to be imported as math/big. Instead got err: %q", err)
+	}
+}
+
+// unclosed brackets are reported with the line and kind of the opener
+func TestUnclosedBrackets(t *testing.T) {
+	tests := []struct {
+		code    string
+		line    int
+		bracket byte
+	}{
+		{"x := 1\nif x > 0 {\n  p x\n", 2, '{'},
+		{"p 1\nimport (\n  \"strings\"\n", 2, '('},
+		{"p 1\ns := \"abc\np s\n", 2, 0},
+	}
+	for _, test := range tests {
+		res := eval.EvalResult(test.code, eval.Options{})
+		e := res.SyntaxError
+		if e == nil || e.Line != test.line || e.Bracket != test.bracket || res.Err != e.Error() {
+			t.Errorf("Expected a syntax error on line %d. Instead got %+v, err: %q", test.line, e, res.Err)
+		}
+	}
+	res := eval.EvalResult("x := 1\nif x > 0 {\n  p x\n", eval.Options{})
+	if res.Err != ":2: '{' is never closed" {
+		t.Errorf("Unexpected error message %q", res.Err)
+	}
+
+	// nested brackets that are closed correctly
+	code := `
+         func f(a int) (
+             int, error,
+         ) {
+             if a > 0 {
+                 return a, nil
+             }
+             return 0, nil
+         }
+         p f(10)
+        `
+	check(t, code, "10\n<nil>", "")
+}
+
+// package-like references inside strings and struct tags don't cause imports
+func TestNoInferenceInStrings(t *testing.T) {
+	code := "s := \"call sort.Sort\"\ntype T struct {\n  F int `json:\"time.Now\"`\n}\np s, T{}"
+	_, _, pkgsToImport, _, err := eval.Partition(code, eval.BuiltinPkgs())
+	if err != nil || len(pkgsToImport) != 0 {
+		t.Errorf("Expected no packages to be inferred. Instead got %v, err: %v", pkgsToImport, err)
+	}
+	check(t, code, "call sort.Sort\n{F:0}", "")
+}
+
+// keywords and predeclared names are never taken to be packages, even if configured
+func TestNoInferenceOfKeywords(t *testing.T) {
+	code := "var e error = errors.New(\"x\")\np error.Error(e), len.x, range.y, append.z, make.a, new.b, map.c, chan.d, func.e"
+	knownPkgs := map[string]string{}
+	for _, name := range []string{"error", "len", "range", "append", "make", "new", "map", "chan", "func"} {
+		knownPkgs[name] = "example.com/" + name
+	}
+	pkgsToImport := map[string]string{}
+	eval.InferPackages(code, knownPkgs, pkgsToImport)
+	if len(pkgsToImport) != 0 {
+		t.Errorf("Expected no packages to be inferred. Instead got %v", pkgsToImport)
+	}
+	_, _, _, warnings, _ := eval.Partition(code, eval.BuiltinPkgs())
+	if len(warnings) != 0 {
+		t.Errorf("Expected no warnings. Instead got %q", warnings)
+	}
+}
+
+// EvalTo writes the same output as Eval returns, and still returns errors separately
+func TestEvalTo(t *testing.T) {
+	code := "for i := 0; i < 3; i++ {\n  p i\n}\nfmt.Fprintln(os.Stderr, \"done\")"
+	var buf bytes.Buffer
+	err := eval.EvalTo(&buf, code)
+	out, _ := eval.Eval(code)
+	if err != "" || buf.String() != out {
+		t.Errorf("Expected output %q. Instead got %q, err: %q", out, buf.String(), err)
+	}
+
+	buf.Reset()
+	err = eval.EvalTo(&buf, `mt.Println("gore test")`)
+	if buf.Len() != 0 || !strings.Contains(err, ":1: undefined: mt") {
+		t.Errorf("Expected only a compiler error. Instead got out: %q, err: %q", buf.String(), err)
+	}
+}
+
+// EvalLines attributes the output of p statements to their lines, and strips the markers
+func TestEvalLines(t *testing.T) {
+	type outLine struct {
+		line int
+		text string
+	}
+	code := "x := 2\np x\nfmt.Println(\"plain\")\n\nfor i := 0; i < 2; i++ {\n  p i, \"a\\nb\"\n}\npr \"no newline \"; p x*x\npr \"end\""
+	var got []outLine
+	err := eval.EvalLines(code, func(line int, text string) { got = append(got, outLine{line, text}) })
+	want := []outLine{{2, "2"}, {0, "plain"}, {6, "0"}, {6, "a"}, {6, "b"}, {6, "1"}, {6, "a"}, {6, "b"}, {8, "no newline 4"}, {0, "end"}}
+	if err != "" || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected %v. Instead got %v, err %q", want, got, err)
+	}
+	for _, l := range got {
+		if strings.Contains(l.text, "\x00") || strings.Contains(l.text, "gore:line") {
+			t.Errorf("Expected the marker to be stripped from %q", l.text)
+		}
+	}
+
+	if err := eval.EvalLines("p 1\np y", func(int, string) { t.Error("Expected no output") }); err != ":2: undefined: y\n" {
+		t.Errorf("Expected the error on line 2. Instead got %q", err)
+	}
+}
+
+// ShowAllErrors reports the errors that the compiler would otherwise leave out
+func TestShowAllErrors(t *testing.T) {
+	var code, all string
+	for i := 1; i <= 15; i++ {
+		code += fmt.Sprintf("p u%d\n", i)
+		all += fmt.Sprintf(":%d: undefined: u%d\n", i, i)
+	}
+	if _, err := eval.Eval(code); !strings.HasSuffix(err, ":10: undefined: u10\n:10: too many errors\n") {
+		t.Errorf("Expected the errors to stop at the tenth. Instead got %q", err)
+	}
+	for _, mode := range []eval.ExecMode{eval.RunMode, eval.BuildMode} {
+		opts := eval.Options{ShowAllErrors: true, ExecMode: mode}
+		if _, err := eval.EvalWithOptions(code, opts); err != all {
+			t.Errorf("Expected all 15 errors in mode %v. Instead got %q", mode, err)
+		}
+	}
+}
+
+// StderrPrefix tags the lines written to stderr, in order with those written to stdout
+func TestStderrPrefix(t *testing.T) {
+	code := "p \"out 1\"\nfor i := 0; i < 3; i++ {\n  time.Sleep(20 * time.Millisecond)\n  e \"err\", i\n  time.Sleep(20 * time.Millisecond)\n  p i\n}"
+	opts := eval.Options{StderrPrefix: "[stderr] "}
+	want := "out 1\n[stderr] err\n[stderr] 0\n0\n[stderr] err\n[stderr] 1\n1\n[stderr] err\n[stderr] 2\n2\n"
+	if out, err := eval.EvalWithOptions(code, opts); out != want || err != "" {
+		t.Errorf("Expected %q. Instead got %q, err %q", want, out, err)
+	}
+	var buf bytes.Buffer
+	if err := eval.EvalTo(&buf, code, func(o *eval.Options) { o.StderrPrefix = "E| " }); buf.String() != strings.Replace(want, "[stderr] ", "E| ", -1) || err != "" {
+		t.Errorf("Expected the streamed output tagged. Instead got %q, err %q", buf.String(), err)
+	}
+
+	// the panic that ends a run is still told from the output, and isn't tagged
+	out, err := eval.EvalWithOptions("p \"before\"\ntime.Sleep(20 * time.Millisecond)\ne \"warning\"\ntime.Sleep(20 * time.Millisecond)\npanic(\"boom\")", opts)
+	if out != "before\n[stderr] warning\n" || !strings.HasPrefix(err, "panic: boom\n") || !strings.Contains(err, "\ngoroutine 1 ") ||
+		strings.Contains(err, "[stderr]") {
+		t.Errorf("Expected the panic in err. Instead got out %q, err %q", out, err)
+	}
+	if _, err := eval.EvalWithOptions("p x", opts); err != ":1: undefined: x\n" {
+		t.Errorf("Expected an untagged compile error. Instead got %q", err)
+	}
+}
+
+// SeparateStderr returns what the code logs to stderr apart from its output, whether or
+// not it succeeds
+func TestSeparateStderr(t *testing.T) {
+	opts := eval.Options{SeparateStderr: true}
+	res := eval.EvalResult("log.SetFlags(0)\np \"out\"\nlog.Print(\"logged\")\ne \"warning\"\npr \"done\"", opts)
+	if res.Out != "out\ndone" || res.Stderr != "logged\nwarning\n" || res.Err != "" {
+		t.Errorf("Expected stdout and stderr apart. Instead got %+v", res)
+	}
+	res = eval.EvalResult("log.SetFlags(0)\np \"before\"\nlog.Print(\"logged\")\ntime.Sleep(20 * time.Millisecond)\npanic(\"boom\")", opts)
+	if res.Out != "before\n" || res.Stderr != "logged\n" || !strings.HasPrefix(res.Err, "panic: boom\n") {
+		t.Errorf("Expected the panic in Err. Instead got %+v", res)
+	}
+	if res := eval.EvalResult("log.SetFlags(0)\nlog.Print(\"logged\")\nos.Exit(3)", opts); res.Stderr != "logged\n" || res.Err != "exit status 3\n" {
+		t.Errorf("Expected the exit status in Err. Instead got %+v", res)
+	}
+	if res := eval.EvalResult("log.Print(\"logged\")", eval.Options{}); !strings.HasSuffix(res.Out, "logged\n") || res.Stderr != "" {
+		t.Errorf("Expected the log in Out by default. Instead got %+v", res)
+	}
+	// neither stream ends in a newline, and either may be merged first
+	for i := 0; i < 3; i++ {
+		res = eval.EvalResult("fmt.Fprint(os.Stderr, \"warn\")\npr \"done\"", opts)
+		if res.Out != "done" || res.Stderr != "warn" || res.Err != "" {
+			t.Errorf("Expected unterminated output apart from unterminated stderr. Instead got %+v", res)
+		}
+	}
+}
+
+// GoDebug sets GODEBUG for the code, whose runtime diagnostics are kept apart from its output
+func TestGoDebug(t *testing.T) {
+	code := "var keep [][]byte\nfor i := 0; i < 3; i++ {\n  keep = append(keep, make([]byte, 1<<20))\n  runtime.GC()\n}\np len(keep)"
+	res := eval.EvalResult(code, eval.Options{GoDebug: "gctrace=1"})
+	if res.Out != "3\n" || res.Err != "" || !strings.HasPrefix(res.Stderr, "gc 1 @") {
+		t.Errorf("Expected gctrace lines in Stderr only. Instead got %+v", res)
+	}
+	if res := eval.EvalResult(code, eval.Options{}); res.Out != "3\n" || res.Stderr != "" {
+		t.Errorf("Expected no trace without GoDebug. Instead got %+v", res)
+	}
+}
+
+// Profile returns a CPU or heap profile of the run, in pprof's gzipped format
+func TestProfile(t *testing.T) {
+	code := "sum := 0\nfor start := time.Now(); time.Since(start) < 200*time.Millisecond; {\n  sum += len(fmt.Sprint(sum))\n}\nkeep := make([]byte, 1<<20)\np sum > 0, len(keep)"
+	for _, kind := range []eval.ProfileKind{eval.CPUProfile, eval.HeapProfile} {
+		res := eval.EvalResult(code, eval.Options{Profile: kind})
+		if res.Out != "true\n1048576\n" || res.Err != "" || !bytes.HasPrefix(res.Profile, []byte{0x1f, 0x8b}) {
+			t.Errorf("%v: Expected a profile. Instead got out %q, err %q, %d bytes of profile", kind, res.Out, res.Err, len(res.Profile))
+		}
+	}
+	if res := eval.EvalResult("p 1", eval.Options{}); res.Profile != nil {
+		t.Errorf("Expected no profile by default. Instead got %d bytes", len(res.Profile))
+	}
+	// lines keep their numbers
+	if _, err := eval.EvalWithOptions("p 1\np x", eval.Options{Profile: eval.CPUProfile}); err != ":2: undefined: x\n" {
+		t.Errorf("Expected the error on line 2. Instead got %q", err)
+	}
+}
+
+// PseudoTTY gives the code a terminal for its output, on Linux
+func TestPseudoTTY(t *testing.T) {
+	code := "fi, _ := os.Stdout.Stat()\np fi.Mode()&os.ModeCharDevice != 0\nfmt.Fprintln(os.Stderr, \"stderr\")"
+	check(t, code, "false\nstderr", "")
+	want := "true\nstderr\n" // and "\n" isn't translated to "\r\n"
+	if runtime.GOOS != "linux" {
+		want = "false\nstderr\n"
+	}
+	for _, mode := range []eval.ExecMode{eval.RunMode, eval.BuildMode} {
+		out, err := eval.EvalWithOptions(code, eval.Options{PseudoTTY: true, ExecMode: mode})
+		if out != want || err != "" {
+			t.Errorf("Expected %q in mode %v. Instead got %q, err %q", want, mode, out, err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := eval.EvalTo(&buf, code, func(o *eval.Options) { o.PseudoTTY = true }); buf.String() != want || err != "" {
+		t.Errorf("Expected %q streamed. Instead got %q, err %q", want, buf.String(), err)
+	}
+	if _, err := eval.EvalWithOptions("p u", eval.Options{PseudoTTY: true}); err != ":1: undefined: u\n" {
+		t.Errorf("Expected the compile error. Instead got %q", err)
+	}
+}
+
+// Coverage counts the runs of each line, including those of branches not taken
+func TestCoverage(t *testing.T) {
+	code := "x := 3\nif x > 5 {\n  p \"big\"\n} else {\n  p \"small\"\n}\nfor i := 0; i < 3; i++ {\n  x += i\n}\n// a comment\np x"
+	res := eval.EvalResult(code, eval.Options{Coverage: true})
+	want := map[int]int{1: 1, 2: 1, 3: 0, 5: 1, 7: 1, 8: 3, 11: 1}
+	if res.Err != "" || res.Out != "small\n6\n" || fmt.Sprint(res.Coverage) != fmt.Sprint(want) {
+		t.Errorf("Expected coverage %v. Instead got %v, out %q, err %q, warnings %q", want, res.Coverage, res.Out, res.Err, res.Warnings)
+	}
+	if res := eval.EvalResult(code, eval.Options{}); res.Coverage != nil {
+		t.Errorf("Expected no coverage without the option. Instead got %v", res.Coverage)
+	}
+}
+
+// DenyImports rejects snippets that import denied packages, explicitly or not
+func TestDenyImports(t *testing.T) {
+	opts := eval.Options{DenyImports: []string{"os/exec", "syscall", "net/..."}}
+	tests := []struct{ code, err string }{
+		{"x := 1\nout, _ := exec.Command(\"ls\").Output()\np x, out", ":2: import of \"os/exec\" is denied\n"},
+		{"import \"os/exec\"\np exec.ErrNotFound", ":1: import of \"os/exec\" is denied\n"},
+		{"import run \"os/exec\"\n\np run.ErrNotFound", ":1: import of \"os/exec\" is denied\n"},
+		{"p 1\np syscall.Getpid() > 0", ":2: import of \"syscall\" is denied\n"},
+		{"p http.StatusOK", ":1: import of \"net/http\" is denied\n"},
+		{"package main\n\nimport \"os/exec\"\n\nfunc main() { println(exec.ErrNotFound) }", ":3: import of \"os/exec\" is denied\n"},
+		{"p os.Getpid() > 0, strings.ToUpper(\"ok\")", ""},
+	}
+	for _, test := range tests {
+		if out, err := eval.EvalWithOptions(test.code, opts); err != test.err {
+			t.Errorf("%q: Expected err %q. Instead got %q, out %q", test.code, test.err, err, out)
+		}
+	}
+	check(t, "p exec.ErrNotFound != nil", "true", "") // only denied with the option
+}
+
+// whitespace and comments alone are a valid no-op
+func TestBlank(t *testing.T) {
+	for _, code := range []string{"", "  \n\t\n", "// hi\n/* multi\n line */", "   \n  // hi\n", ";", " ; ;\n// hi ;\n;"} {
+		start := time.Now()
+		out, err := eval.Eval(code)
+		if out != "" || err != "" {
+			t.Errorf("Expected no output or error for %q. Instead got out: %q, err: %q", code, out, err)
+		}
+		if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+			t.Errorf("Expected %q not to be compiled, but it took %v", code, elapsed)
+		}
+	}
+
+	// declarations alone are compiled and run, for their side effects
+	check(t, "type T int // ;\nfunc init() { println(\"init\", T(1)) }", "init 1", "")
+	check(t, "type T int;", "", "")
+	check(t, "; x := 1", "", ":1: declared and not used: x")
+}
+
+// "//gore:require" imports a package that the code needs only for its side effects
+func TestRequireDirective(t *testing.T) {
+	// image/gif's init registers its decoder with image
+	code := "//gore:require image/gif\n_, kind, _ := image.Decode(strings.NewReader(\"GIF89a\"))\np kind == \"gif\""
+	check(t, code, "true", "")
+	check(t, code[len("//gore:require image/gif"):], "false", "")
+	check(t, "  //gore:require \"image/png\"\n_, kind, err := image.Decode(strings.NewReader(\"\\x89PNG\\r\\n\\x1a\\n\"))\np kind, err != nil", "png\ntrue", "")
+
+	// errors refer to the directive's line (whatever the go tool makes of the missing
+	// package, which depends on the network), and a directive in a string is left alone
+	if _, err := eval.Eval("p 1\n//gore:require example.com/no/such/pkg"); !regexp.MustCompile(`^:?2:`).MatchString(err) {
+		t.Errorf("Expected an error on line 2. Instead got %q", err)
+	}
+	check(t, "s := `\n//gore:require expvar\n`\npr s", "\n//gore:require expvar\n", "")
+}
+
+// AutoCheckErr prints errors from "v, err :=" statements, which are otherwise unused
+func TestAutoCheckErr(t *testing.T) {
+	tests := []struct{ code, out, err string }{
+		{`f, err := os.Open("/no/such/file"); p f == nil`, "open /no/such/file: no such file or directory\ntrue", ""},
+		{`n, err := strconv.Atoi("12"); p n`, "12", ""},
+		{"err := errors.New(\"oops\")\nvar x, err2 = 1, err\np x, err2", "oops\n1\noops", ""},
+		{"if _, err := strconv.Atoi(\"x\"); err == nil {\n  p \"unreachable\"\n}", "", ""},
+		{"n, err := strconv.Atoi(\n  \"x\")\np n", "", ":1: declared and not used: err"},
+	}
+	for _, test := range tests {
+		out, err := eval.EvalWithOptions(test.code, eval.Options{AutoCheckErr: true})
+		if ts(out) != test.out || !strings.Contains(err, test.err) || test.err == "" && err != "" {
+			t.Errorf("%q: Expected out %q, err %q. Instead got out %q, err %q", test.code, test.out, test.err, out, err)
+		}
+	}
+	check(t, `n, err := strconv.Atoi("12"); p n`, "", ":1: declared and not used: err")
+}
+
+// "e" prints to stderr, and its helper (and "os" import) is only emitted when used
+func TestStderrAlias(t *testing.T) {
+	check(t, `p "no e"`, "no e", "")
+	if src := eval.Generate(`p "no e"`); strings.Contains(src, "__e") {
+		t.Errorf("Expected no __e helper in:\n%s", src)
+	}
+
+	code := "e := 1\np e\ne \"oops\""
+	check(t, code, "1\noops", "")
+	if src := eval.Generate(code); !strings.Contains(src, "__fmt.Fprintf(__os.Stderr") {
+		t.Errorf("Expected the __e helper in:\n%s", src)
+	}
+	res := eval.EvalResult(`e "oops", !false`, eval.Options{SeparateStderr: true})
+	if res.Out != "" || res.Stderr != "oops\ntrue\n" || res.Err != "" {
+		t.Errorf("Expected the output in Stderr only. Instead got %+v", res)
+	}
+
+	// a variable named e is updated, not printed
+	check(t, "e := 1\ne += 1\ne *= 3\np e", "6", "")
+	check(t, "e := make(chan int, 1)\ne <- 5\nx := <-e\np x", "5", "")
+}
+
+// unused imports are attributed to the user's code or to gore's inference
+func TestUnusedImportOrigin(t *testing.T) {
+	code := `
+        import "regexp"
+        p 10
+        `
+	check(t, code, "", `:2: "regexp" imported and not used (explicit import)`)
+
+	// gore's own imports are normally repaired, so exercise the annotation directly
+	err := "/tmp/gore_eval.go:3:8: \"math\" imported and not used\n:4: \"sort\" imported and not used\n:5: undefined: x\n"
+	expected := "/tmp/gore_eval.go:3:8: \"math\" imported and not used (import inferred by gore)\n" +
+		":4: \"sort\" imported and not used (explicit import)\n:5: undefined: x\n"
+	if annotated := eval.AnnotateUnusedImports(err); annotated != expected {
+		t.Errorf("Expected\n%s\nInstead got:\n%s", expected, annotated)
+	}
+}
+
+// DisplayFilename names the snippet in its errors and warnings
+func TestDisplayFilename(t *testing.T) {
+	opts := eval.Options{DisplayFilename: "snippet.go"}
+	tests := []struct{ code, err string }{
+		{"p 1\np y", "snippet.go:2: undefined: y\n"},
+		{"x := (", "snippet.go:1: '(' is never closed"},
+		{"p 1", ""},
+	}
+	for _, test := range tests {
+		if _, err := eval.EvalWithOptions(test.code, opts); err != test.err {
+			t.Errorf("%q: Expected err %q. Instead got %q", test.code, test.err, err)
+		}
+	}
+	opts.Vet = true
+	if res := eval.EvalResult("fmt.Printf(\"%d\\n\", \"s\")", opts); len(res.Warnings) != 1 || !strings.HasPrefix(res.Warnings[0], "snippet.go:1: ") {
+		t.Errorf("Expected a vet warning naming the snippet. Instead got %q", res.Warnings)
+	}
+}
+
+// errors are remapped by file: those in the generated code's annotated lines refer to the
+// snippet, and those in its other lines to "<generated>", while other files' pass through
+func TestFormatErrorsByFile(t *testing.T) {
+	dir := t.TempDir()
+	gen := filepath.Join(dir, "gore_eval_123.go")
+	os.WriteFile(gen, []byte("package main\n\nvar g = undefinedG\n\nfunc main() {\n//line :1\nx := undefinedA\n//line :2\nprintln(x, helper())\n}\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "extra.go"), []byte("package main\n\nfunc helper() int {\n\treturn undefinedB\n}\n"), 0600)
+	cmd := exec.Command("go", "build", "-o", os.DevNull, "gore_eval_123.go", "extra.go")
+	cmd.Dir = dir
+	out, _ := cmd.CombinedOutput()
+
+	want := []string{"<generated>:3:9: undefined: undefinedG", ":1: undefined: undefinedA", "./extra.go:4:9: undefined: undefinedB"}
+	errs := strings.Split(strings.TrimSpace(eval.FormatErrors(string(out), gen)), "\n")
+	sort.Strings(errs)
+	sort.Strings(want)
+	if fmt.Sprint(errs) != fmt.Sprint(want) {
+		t.Errorf("Expected %q. Instead got %q from:\n%s", want, errs, out)
+	}
+}
+
+func TestGOMAXPROCS(t *testing.T) {
+	out, err := eval.EvalWithOptions("p runtime.GOMAXPROCS(0)", eval.Options{GOMAXPROCS: 1})
+	if ts(out) != "1" || err != "" {
+		t.Errorf("Expected GOMAXPROCS to be 1. Instead got out: %q, err: %q", out, err)
+	}
+}
+
+// binary output is returned as is, unless ValidUTF8 is set
+func TestValidUTF8(t *testing.T) {
+	code := "os.Stdout.Write([]byte{'a', 0xff, 0xfe, 'b'})\npanic(string([]byte{0xff}))"
+	out, err := eval.Eval(code)
+	if out != "a\xff\xfeb" || !strings.Contains(err, "panic: \xff") {
+		t.Errorf("Expected the raw bytes. Instead got out %q, err %q", out, err)
+	}
+	out, err = eval.EvalWithOptions(code, eval.Options{ValidUTF8: true})
+	if out != "a\uFFFDb" || !strings.Contains(err, "panic: \uFFFD") || !utf8.ValidString(err) {
+		t.Errorf("Expected invalid UTF-8 to be replaced. Instead got out %q, err %q", out, err)
+	}
+}
+
+// GOEXPERIMENT is set for the go tool, and seen by the program
+func TestGoExperiment(t *testing.T) {
+	out, err := eval.EvalWithOptions(`p os.Getenv("GOEXPERIMENT")`, eval.Options{GoExperiment: "loopvar"})
+	if ts(out) != "loopvar" || err != "" {
+		t.Errorf("Expected GOEXPERIMENT to be loopvar. Instead got out: %q, err: %q", out, err)
+	}
+	_, err = eval.EvalWithOptions(`p 1`, eval.Options{GoExperiment: "bogus"})
+	if !strings.Contains(err, "unknown GOEXPERIMENT bogus") {
+		t.Errorf("Expected the go tool to reject the experiment. Instead got err: %q", err)
+	}
+}
+
+// SupportedGoPackages returns a copy, which can't be used to change what's inferred
+func TestSupportedGoPackages(t *testing.T) {
+	if eval.Version() == "" {
+		t.Errorf("Expected a version")
+	}
+	pkgs := eval.SupportedGoPackages()
+	if pkgs["json"] != "encoding/json" || len(pkgs) != len(eval.BuiltinPkgs()) {
+		t.Errorf("Expected all the standard packages. Instead got %v", pkgs)
+	}
+	pkgs["json"] = "example.com/json"
+	delete(pkgs, "strings")
+	if again := eval.SupportedGoPackages(); again["json"] != "encoding/json" || again["strings"] != "strings" {
+		t.Errorf("Expected an unmodified copy. Instead got %v", again)
+	}
+	check(t, `p strings.ToUpper("copy")`, "COPY", "")
+}
+
+// fmt is imported for the snippet only if it uses fmt, whether or not it prints with p
+func TestFmtImportedOnlyIfUsed(t *testing.T) {
+	for _, code := range []string{"x := 1\nx++", "p 1"} {
+		if src := eval.Generate(code); strings.Contains(src, "import \"fmt\"") {
+			t.Errorf("Expected no import of fmt for the snippet in:\n%s", src)
+		}
+	}
+	if src := eval.Generate(`fmt.Println("hi")`); !strings.Contains(src, "import \"fmt\"") {
+		t.Errorf("Expected an import of fmt in:\n%s", src)
+	}
+	check(t, "x := 1\nx++", "", "")
+	check(t, "import \"fmt\"\nfmt.Println(\"explicit\")\np \"and p\"", "explicit\nand p", "")
+	check(t, "fmt := 1\np fmt", "1", "")
+}
+
+// the helpers for p and t, and their import of fmt, are only generated if used
+func TestHelpersOnlyIfUsed(t *testing.T) {
+	src := eval.Generate("x := 1\nx++")
+	if strings.Contains(src, "__p") || strings.Contains(src, "__t") || strings.Contains(src, "fmt") {
+		t.Errorf("Expected no helpers or fmt import in:\n%s", src)
+	}
+	src = eval.Generate("p 1\nt 1\ne 1")
+	if strings.Count(src, "import __fmt \"fmt\"") != 1 || !strings.Contains(src, "func __p(") || !strings.Contains(src, "func __t(") {
+		t.Errorf("Expected the helpers, with a single import of fmt, in:\n%s", src)
+	}
+	check(t, "p 1\nt 1", "1\nint", "")
+
+	// a snippet's own __p is left alone
+	check(t, "func __p(s string) { println(\"mine:\", s) }\n__p(\"x\")", "mine: x", "")
+}
+
+// the generated code doesn't depend on map iteration order
+func TestDeterministicImports(t *testing.T) {
+	code := "p strings.ToUpper(fmt.Sprint(math.Pi, sort.IsSorted, time.Now, os.Args, bytes.MinRead))"
+	_, nonTopLevel, pkgsToImport, _, _ := eval.Partition(code, eval.BuiltinPkgs())
+	first := eval.BuildMain("", nonTopLevel, pkgsToImport)
+	for i := 0; i < 10; i++ {
+		if src := eval.BuildMain("", nonTopLevel, pkgsToImport); src != first {
+			t.Fatalf("Expected identical code. Instead got:\n%s\nand\n%s", first, src)
+		}
+	}
+	if !strings.Contains(first, "import \"bytes\"\nimport \"fmt\"\nimport \"math\"\nimport \"os\"\n") {
+		t.Errorf("Expected sorted imports in:\n%s", first)
+	}
+}
+
+// final values of variables are returned separately from the output
+func TestEvalAndInspect(t *testing.T) {
+	code := `
+        type P struct{ X, Y int }
+        n := 1
+        for i := 0; i < 3; i++ {
+            n *= 2
+        }
+        s := "two\nlines"
+        pt := P{1, 2}
+        p "done"
+        `
+	out, values, err := eval.EvalAndInspect(code, []string{"n", "s", "nosuch", "pt"})
+	if ts(out) != "done" {
+		t.Errorf("Expected only the snippet's output. Instead got %q", out)
+	}
+	expected := map[string]string{"n": "8", "s": "two\nlines", "pt": "{X:1 Y:2}"}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		t.Errorf("Expected values %v. Instead got %v", expected, values)
+	}
+	if err != "inspect: undefined: nosuch\n" {
+		t.Errorf("Expected an error for the missing variable. Instead got %q", err)
+	}
+}
+
+// package inference over a 10k line snippet, mostly made of repeated references
+func BenchmarkInferPackages(b *testing.B) {
+	code := strings.Repeat("x := strings.Repeat(fmt.Sprint(math.Pi), 2) + y.z\n", 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		eval.InferPackages(code, eval.BuiltinPkgs(), map[string]string{})
+	}
+}
+
+func TestWarm(t *testing.T) {
+	if err := eval.Warm(); err != nil {
+		t.Errorf("Expected Warm to succeed. Instead got %v", err)
+	}
+	if err := eval.Warm(eval.WithGoBinary("/no/such/go")); err == nil || !strings.Contains(err.Error(), "/no/such/go") {
+		t.Errorf("Expected Warm to fail without a go tool. Instead got %v", err)
+	}
+}
+
+// Eval with a fresh build cache, compared with one primed by Warm
+func BenchmarkEvalCold(b *testing.B) {
+	benchmarkEval(b, false)
+}
+
+func BenchmarkEvalWarm(b *testing.B) {
+	benchmarkEval(b, true)
+}
+
+func benchmarkEval(b *testing.B, warm bool) {
+	code := `b, _ := json.Marshal(map[string]int{"a": 1}); p regexp.MustCompile("a+").FindString(string(b))`
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		b.Setenv("GOCACHE", b.TempDir())
+		if warm {
+			if err := eval.Warm(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+		if out, err := eval.Eval(code); ts(out) != "a" {
+			b.Fatalf("Unexpected out %q, err %q", out, err)
+		}
+	}
+}
+
+var ts = strings.TrimSpace
+
+// output printed before a panic is kept, in both exec modes
+func TestOutputBeforePanic(t *testing.T) {
+	for _, mode := range []eval.ExecMode{eval.RunMode, eval.BuildMode} {
+		out, err := eval.EvalWithOptions("p \"before\"\npanic(\"boom\")", eval.Options{ExecMode: mode})
+		if out != "before\n" || !strings.Contains(err, "panic: boom") || strings.Contains(err, "before") {
+			t.Errorf("Mode %d: Expected out \"before\\n\" and the panic in err. Instead got out %q, err %q", mode, out, err)
+		}
+	}
+}
+
+// a toolchain older than MinGoVersion is reported before compiling
+func TestMinGoVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the mock go tool is a shell script")
+	}
+	goTool, e := exec.LookPath("go")
+	if e != nil {
+		t.Skip("go not found")
+	}
+	mock := filepath.Join(t.TempDir(), "go")
+	script := "#!/bin/sh\nif [ \"$1\" = version ]; then echo 'go version go1.17.3 linux/amd64'; exit; fi\nexec " + goTool + " \"$@\"\n"
+	if e := os.WriteFile(mock, []byte(script), 0755); e != nil {
+		t.Fatal(e)
+	}
+
+	tests := []struct{ min, out, err string }{
+		{"1.21", "", "go >= 1.21 is required, but the installed toolchain is go1.17.3"},
+		{"go1.18", "", "go >= 1.18 is required, but the installed toolchain is go1.17.3"},
+		{"1.17.3", "ok\n", ""},
+		{"1.9", "ok\n", ""},
+	}
+	for _, test := range tests {
+		out, err := eval.EvalWithOptions(`p "ok"`, eval.Options{GoBinary: mock, MinGoVersion: test.min})
+		if out != test.out || err != test.err {
+			t.Errorf("MinGoVersion %s: Expected out %q, err %q. Instead got out %q, err %q", test.min, test.out, test.err, out, err)
+		}
+	}
+}
+
+// each go binary's result is reported separately
+func TestEvalMatrix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the mock go tools are shell scripts")
+	}
+	dir := t.TempDir()
+	var binaries []string
+	for _, v := range []string{"1.21", "1.22"} {
+		mock := filepath.Join(dir, "go"+v)
+		if e := os.WriteFile(mock, []byte("#!/bin/sh\necho 'go "+v+" says hi'\n"), 0755); e != nil {
+			t.Fatal(e)
+		}
+		binaries = append(binaries, mock)
+	}
+	results := eval.EvalMatrix(`p "hi"`, binaries)
+	if len(results) != 2 || results[binaries[0]].Out != "go 1.21 says hi\n" || results[binaries[1]].Out != "go 1.22 says hi\n" {
+		t.Errorf("Expected each mock's output. Instead got %+v", results)
+	}
+
+	// a repeated binary is evaluated once, and OnPhase is called one call at a time
+	compiling := 0
+	onPhase := func(o *eval.Options) {
+		o.OnPhase = func(phase string) {
+			if phase == eval.PhaseCompiling {
+				compiling++
+			}
+		}
+	}
+	results = eval.EvalMatrix(`p "hi"`, append(binaries, binaries[0]), onPhase)
+	if len(results) != 2 || compiling != 2 {
+		t.Errorf("Expected 2 evaluations. Instead got %d, with results %+v", compiling, results)
+	}
+}
+
+// a path imported under an alias isn't also imported under its usual name
+func TestExplicitImportAlias(t *testing.T) {
+	code := `
+        import j "encoding/json"
+        b, _ := j.Marshal([]int{1, 2})
+        p string(b)
+        `
+	check(t, code, "[1,2]", "")
+
+	code = `
+        import j "encoding/json"
+        b, _ := j.Marshal(1)
+        c, _ := json.Marshal(2)
+        `
+	res := eval.EvalResult(code, eval.Options{})
+	want := "`json` (line 4) is not imported, since encoding/json is imported as `j`"
+	if !strings.Contains(res.Err, ":4: undefined: json") || len(res.Warnings) != 1 || res.Warnings[0] != want {
+		t.Errorf("Expected json to be undefined, with warning %q. Instead got err %q, warnings %q", want, res.Err, res.Warnings)
+	}
+
+	// an explicit import claims its name, whatever its path
+	code = `
+        import strings "bytes"
+        p strings.Title("gore")
+        `
+	_, _, pkgs, _, _ := eval.Partition(code, eval.BuiltinPkgs())
+	if len(pkgs) != 0 {
+		t.Errorf("Expected no inferred imports. Instead got %v", pkgs)
+	}
+}
+
+// a complete program is run as is, even if comments precede its package clause
+func TestPackageAfterComments(t *testing.T) {
+	prog := "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"hi\") }\n"
+	check(t, "  "+prog, "hi\n", "")
+	check(t, "// Copyright 2024 The Authors.\n\n/* Licensed\n   under MIT */\n"+prog, "hi\n", "")
+	check(t, `x := "package main"; p x`, "package main\n", "")
+}
+
+// deferred calls, including func literals called in place, stay in main and run at its end
+func TestDefer(t *testing.T) {
+	tests := []struct{ code, out string }{
+		{`defer fmt.Println("bye")
+		  p "hi"`, "hi\nbye"},
+		{`defer func() {
+		    if r := recover(); r != nil { p "recovered:", r }
+		  }()
+		  panic("boom")`, "recovered:\nboom"},
+		{`defer func(){ recover() }(); defer fmt.Println("second")
+		  panic(1)`, "second"},
+	}
+	for _, test := range tests {
+		topLevel, _, _, _, err := eval.Partition(test.code, eval.BuiltinPkgs())
+		if err != nil || strings.TrimSpace(topLevel) != "" {
+			t.Errorf("%q: expected everything in main. Instead got top level %q, err %v", test.code, topLevel, err)
+		}
+		check(t, test.code, test.out, "")
+	}
+}
+
+// go statements stay in main, whether they call a declared func or a func literal
+func TestGoStatements(t *testing.T) {
+	code := `
+var wg sync.WaitGroup
+results := make([]int, 3)
+func work(i int, out []int, wg *sync.WaitGroup) {
+	defer wg.Done()
+	out[i] = i * i
+}
+wg.Add(4)
+for i := 0; i < 3; i++ {
+	go work(i, results, &wg)
+}
+done := make(chan string, 1)
+go func() {
+	defer wg.Done()
+	done <- "literal"
+}()
+wg.Wait()
+p results, <-done
+`
+	topLevel, nonTopLevel, _, _, err := eval.Partition(code, eval.BuiltinPkgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(topLevel, "func work(") || strings.Contains(topLevel, "go ") {
+		t.Errorf("Expected only work at the top level. Instead got:\n%s", topLevel)
+	}
+	for _, stmt := range []string{"go work(i, results, &wg)", "go func() {", "done <- \"literal\"", "}()"} {
+		if !strings.Contains(nonTopLevel, stmt) {
+			t.Errorf("Expected %q in main. Instead got:\n%s", stmt, nonTopLevel)
+		}
+	}
+	check(t, code, "[0 1 4]\nliteral", "")
+	check(t, "go func() { p \"one line\" }()\ntime.Sleep(100 * time.Millisecond)", "one line", "")
+	check(t, "gopher := 1\ngo func(){}()\np gopher", "1", "")
+}
+
+// init funcs go to the top level, and run in order before the rest of the snippet
+func TestInit(t *testing.T) {
+	code := `
+          func init() {
+            p "init"
+          }
+          p "main"
+          func init() { p "init 2" }
+         `
+	topLevel, nonTopLevel, _, _, err := eval.Partition(code, eval.BuiltinPkgs())
+	if err != nil || strings.Count(topLevel, "func init()") != 2 || strings.Contains(nonTopLevel, "init") {
+		t.Errorf("Expected both inits at top level. Instead got top level:\n%s\nmain:\n%s\nerr %v", topLevel, nonTopLevel, err)
+	}
+	check(t, code, "init\ninit 2\nmain", "")
+}
+
+// local variables named like packages, used with selectors, don't leave behind imports
+// of those packages, although the imports are inferred (and then repaired) at first
+func TestLocalsNamedLikePackages(t *testing.T) {
+	tests := []struct{ code, out string }{
+		{"start := time.Now()\nt := time.Now(); d := t.Sub(start); p d >= 0", "true"},
+		{"time := struct{ Hour int }{3}; p time.Hour", "3"},
+		{"type S struct{}\nfunc (S) Ints() { p \"ints\" }\nsort := S{}; sort.Ints()", "ints"},
+		{"rand := struct{ Intn func(int) int }{func(n int) int { return n }}; p rand.Intn(5)", "5"},
+		{"var bytes struct{ Len int }; p bytes.Len", "0"},
+		{"type B struct{ s string }\nfunc (b B) String() string { return b.s }\nstrings := B{\"x\"}; p strings.String()", "x"},
+		{"p strings.ToUpper(\"a\")\nif true { strings := []string{\"b\"}; p strings[0] }", "A\nb"},
+	}
+	for _, test := range tests {
+		check(t, test.code, test.out, "")
+	}
+}
+
+// a compiled snippet can be run as often as needed, until it's cleaned up
+func TestCompile(t *testing.T) {
+	binary, err := eval.Compile("p os.Args[1:]")
+	if err != "" {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"a", "b"}, {"c"}} {
+		out, e := exec.Command(binary, args...).Output()
+		if want := fmt.Sprintln(args); e != nil || string(out) != want {
+			t.Errorf("Expected %q. Instead got %q, err %v", want, out, e)
+		}
+	}
+	if e := eval.Cleanup(binary); e != nil {
+		t.Error(e)
+	}
+	if _, e := os.Stat(binary); !os.IsNotExist(e) {
+		t.Errorf("Expected %s to be removed", binary)
+	}
+
+	if binary, err := eval.Compile("x := 1\np x, y"); binary != "" || err != ":2: undefined: y\n" {
+		t.Errorf("Expected a compile error and no binary. Instead got %q, err %q", binary, err)
+	}
+}
+
+// a snippet compiled into a plugin runs in this process each time it is invoked
+func TestCompilePlugin(t *testing.T) {
+	code := `n, _ := strconv.Atoi(os.Getenv("GORE_PLUGIN_RUNS"))
+	         if n == 2 { panic("enough") }
+	         os.Setenv("GORE_PLUGIN_RUNS", strconv.Itoa(n+1))`
+	plugin, err := eval.CompilePlugin(code)
+	if errors.Is(err, eval.ErrPluginsUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GORE_PLUGIN_RUNS", "0")
+	for i := 0; i < 2; i++ {
+		if err := plugin.Invoke(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs := os.Getenv("GORE_PLUGIN_RUNS"); runs != "2" {
+		t.Errorf("Expected 2 runs. Instead got %s", runs)
+	}
+	if err := plugin.Invoke(); err == nil || err.Error() != "panic: enough" {
+		t.Errorf("Expected the panic to be returned. Instead got %v", err)
+	}
+
+	if _, err := eval.CompilePlugin("p x"); err == nil || err.Error() != ":1: undefined: x" {
+		t.Errorf("Expected a compile error. Instead got %v", err)
+	}
+}
+
+// EvalValue returns the value of the snippet's last expression, rather than its output
+func TestEvalValue(t *testing.T) {
+	if _, err := eval.EvalValue("1"); errors.Is(err, eval.ErrPluginsUnsupported) {
+		t.Skip(err)
+	}
+	tests := []struct{ code, want string }{ // the value as %#v formats it
+		{"x := 20\nx*2 + 2", "42"},
+		{"s := []string{\"a\", \"b\"}; strings.Join(s, \";\")\n", `"a;b"`},
+		{"type pair struct{ A, B int }\npair{1, 2}", "main.pair{A:1, B:2}"},
+		{"time.Duration(90) * time.Second", "90000000000"},
+		{"x := 2\nx * 3 // triple", "6"},
+		{"x := 2; x + 1 /* next */", "3"},
+	}
+	for _, test := range tests {
+		v, err := eval.EvalValue(test.code)
+		if err != nil || fmt.Sprintf("%#v", v) != test.want {
+			t.Errorf("%q: Expected %s. Instead got %#v, err %v", test.code, test.want, v, err)
+		}
+	}
+	if v, _ := eval.EvalValue("time.Second"); v != time.Second {
+		t.Errorf("Expected a time.Duration. Instead got %#v", v)
+	}
+
+	for code, want := range map[string]string{
+		"x := 1":                        "the snippet doesn't end in an expression",
+		"y":                             ":1: undefined: y",
+		"var a []int\na[1]":             "panic: runtime error: index out of range [1] with length 0",
+		"fmt.Println()\nos.Getpid(); }": "the snippet doesn't end in an expression",
+	} {
+		if _, err := eval.EvalValue(code); err == nil || err.Error() != want {
+			t.Errorf("%q: Expected error %q. Instead got %v", code, want, err)
+		}
+	}
+}
+
+// the go tool's reports of its own work are split from the start of the output
+func TestToolchainOutput(t *testing.T) {
+	tests := []struct{ out, chatter, rest string }{
+		{"go: downloading golang.org/x/text v0.14.0\ngo: added golang.org/x/text v0.14.0\nhello\n",
+			"go: downloading golang.org/x/text v0.14.0\ngo: added golang.org/x/text v0.14.0\n", "hello\n"},
+		{"go: finding module for package example.com/m\n# command-line-arguments\n./x.go:3:2: undefined: m\n",
+			"go: finding module for package example.com/m\n", "# command-line-arguments\n./x.go:3:2: undefined: m\n"},
+		{"hello\ngo: downloading is just output here\n", "", "hello\ngo: downloading is just output here\n"},
+		{"go: downloading example.com/m v1.0.0", "go: downloading example.com/m v1.0.0", ""},
+		{"go: cannot find main module\n", "", "go: cannot find main module\n"},
+		{"go: downloading the report now\n", "", "go: downloading the report now\n"},
+		{"go: downloading go1.22.0 (linux/amd64)\nhello\n", "go: downloading go1.22.0 (linux/amd64)\n", "hello\n"},
+	}
+	for _, test := range tests {
+		chatter, rest := eval.SplitToolchainOutput([]byte(test.out))
+		if chatter != test.chatter || string(rest) != test.rest {
+			t.Errorf("%q: expected %q and %q. Instead got %q and %q", test.out, test.chatter, test.rest, chatter, rest)
+		}
+	}
+	if res := eval.EvalResult(`p "go: downloading"`, eval.Options{}); res.Out != "go: downloading\n" || res.ToolchainOutput != "" {
+		t.Errorf("Expected the program's output to be left alone. Instead got %+v", res)
+	}
+	code := "p \"go: downloading the report now\"\np \"go: downloading example.com/m v1.0.0\""
+	expected := "go: downloading the report now\ngo: downloading example.com/m v1.0.0\n"
+	if res := eval.EvalResult(code, eval.Options{}); res.Out != expected || res.ToolchainOutput != "" {
+		t.Errorf("Expected the program's output to be left alone. Instead got %+v", res)
+	}
+	// a binary's output is never split, even if it names a version
+	code = "p \"go: downloading example.com/m v1.0.0\"\np \"done\""
+	if res := eval.EvalResult(code, eval.Options{ExecMode: eval.BuildMode}); res.Out != "go: downloading example.com/m v1.0.0\ndone\n" || res.ToolchainOutput != "" {
+		t.Errorf("Expected the binary's output to be left alone. Instead got %+v", res)
+	}
+}
+
+// SourceTransform sees the generated program, and errors still refer to the snippet's lines
+func TestSourceTransform(t *testing.T) {
+	var seen string
+	transform := func(src string) string {
+		seen = src
+		src = "// Code generated by gore. DO NOT EDIT.\n\n" + src
+		src = strings.Replace(src, "func main() {\n", "func main() {\n\t// entered main\n\n", 1)
+		return src + "\nfunc init() { println(\"injected\") }\n"
+	}
+	opts := eval.Options{SourceTransform: transform}
+	out, err := eval.EvalWithOptions("x := 2\np x", opts)
+	if out != "injected\n2\n" || err != "" || !strings.Contains(seen, "package main") || !strings.Contains(seen, "//line :2") {
+		t.Errorf("Expected the transformed program to run. Instead got %q, err %q, from:\n%s", out, err, seen)
+	}
+	if _, err := eval.EvalWithOptions("x := 2\n\np x, y", opts); err != ":3: undefined: y\n" {
+		t.Errorf("Expected the error on line 3. Instead got %q", err)
+	}
+}
+
+// OnPhase hears of each phase as it starts, including a repair of the inferred imports
+func TestOnPhase(t *testing.T) {
+	var phases []string
+	opts := eval.Options{ExecMode: eval.BuildMode, OnPhase: func(phase string) { phases = append(phases, phase) }}
+	out, err := eval.EvalWithOptions("var b bytes .Buffer\nb.WriteString(\"gore\")\np b.String()", opts)
+	if out != "gore\n" || err != "" {
+		t.Errorf("Expected gore. Instead got %q, err %q", out, err)
+	}
+	if fmt.Sprint(phases) != "[compiling repairing-imports compiling running]" {
+		t.Errorf("Unexpected phases %v", phases)
+	}
+
+	phases = nil
+	opts.ExecMode, opts.Vet = eval.RunMode, true
+	eval.EvalWithOptions("p 1", opts)
+	if fmt.Sprint(phases) != "[compiling vetting]" {
+		t.Errorf("Unexpected phases %v", phases)
+	}
+}
+
+// control flow statements stay in main, in one piece, and aliases are expanded in their
+// blocks. A block ends where it is closed, even if that's not at the start of a line.
+func TestControlFlow(t *testing.T) {
+	tests := []struct {
+		code     string
+		topLines int // the number of lines that belong at the top level
+		out      string
+	}{
+		{"x := 1\nif x > 1 { p 1 } else { p 2 }", 0, "2"},
+		{"x := 3\nif x == 1 {\n p 1\n} else if x == 2 {\n p 2\n} else {\n p 3 }", 0, "3"},
+		{"for i := 0; i < 3; i++ { if i%2 == 0 { p i } else { t i } }", 0, "0\nint\n2"},
+		{"switch x := 2; x {\ncase 1:\n p 1\ncase 2: { p 2; p \"two\" }\ndefault:\n p 3\n}", 0, "2\ntwo"},
+		{"ch := make(chan int, 1); ch <- 5\nselect {\ncase v := <-ch: { p v }\ndefault:\n p 0\n}", 0, "5"},
+		{"type P struct { p int; t string }\nv := P{p: 1, t: \"{\"}; if v.p == 1 { p v } // p v", 1, "{p:1 t:{}"},
+		{"func f(a, b int) int {\n  return a +\n    b }\nx := f(\n  1, 2); p x", 3, "3"},
+	}
+	for _, test := range tests {
+		topLevel, nonTopLevel, _, _, err := eval.Partition(test.code, eval.BuiltinPkgs())
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.code, err)
+			continue
+		}
+		topLines := 0
+		for _, l := range strings.Split(topLevel, "\n") {
+			if l != "" && !strings.HasPrefix(l, "//line ") {
+				topLines++
+			}
+		}
+		if topLines != test.topLines {
+			t.Errorf("%q: expected %d lines at top level. Instead got top level:\n%s\nmain:\n%s", test.code, test.topLines, topLevel, nonTopLevel)
+		}
+		check(t, test.code, test.out, "")
+	}
+}
+
+// the elements of composite literals aren't statements, and aliases aren't expanded in
+// them, but they are in the blocks of the func literals among them
+func TestLiteralsInBlocks(t *testing.T) {
+	check(t, "e := 2; ys := []int{e * 2, 3}; p ys", "[4 3]", "")
+	check(t, "p, t := 1, 2\nif p > 0 { xs := [][]int{{p , 2}, {t\t, 1}}; fmt.Println(xs) }", "[[1 2] [2 1]]", "")
+	check(t, "type T struct{ p, t int }\nfor _, v := range []T{{p: 1}, {t: 2}} { p v }", "{p:1 t:0}\n{p:0 t:2}", "")
+	check(t, "fs := []func(){func() { p 1 }, func() { p 2 }}; for _, f := range fs { f() }", "1\n2", "")
+	check(t, "xs := []int{3, 1, 2}; sort.Slice(xs, func(i, j int) bool { return xs[i] < xs[j] }); p xs", "[1 2 3]", "")
+}
+
+// pj prints values as indented JSON, or with %+v if they can't be marshalled
+func TestPrintJSON(t *testing.T) {
+	check(t, `pj map[string][]int{"b": {2, 3}, "a": {1}}`, `{
+  "a": [
+    1
+  ],
+  "b": [
+    2,
+    3
+  ]
+}`, "")
+	check(t, `
+         type Point struct { X, Y int; Label string `+"`json:\"label,omitempty\"`"+` }
+         pj Point{1, 2, "origin"}, []Point{{3, 4, ""}}
+        `, `{
+  "X": 1,
+  "Y": 2,
+  "label": "origin"
+}
+[
+  {
+    "X": 3,
+    "Y": 4
+  }
+]`, "")
+	check(t, `ch := make(chan int); pj 1, ch == nil, struct{ F func() }{}`, "1\nfalse\n{F:<nil>}", "")
+
+	// encoding/json is only imported when pj is used, so a snippet can have its own json
+	if src := eval.Generate("p 1"); strings.Contains(src, "encoding/json") {
+		t.Errorf("Expected encoding/json not to be imported. Instead got:\n%s", src)
+	}
+}
+
+// the go/... packages are inferred, to parse and print Go code, without taking over
+// locals named like them
+func TestGoSourcePackages(t *testing.T) {
+	code := "src := []byte(\"package main\\nfunc  f( ) {x:=1}\")\nout, err := format.Source(src)\np string(out), err"
+	check(t, code, "package main\n\nfunc f() { x := 1 }\n\n<nil>", "")
+
+	code = "fset := token.NewFileSet()\nf, _ := parser.ParseFile(fset, \"\", \"package p\\nvar  v =1+2\", 0)\n" +
+		"printer.Fprint(os.Stdout, fset, f.Decls[0])\np \"\"\nast.Inspect(f, func(n ast.Node) bool {\n  if lit, ok := n.(*ast.BasicLit); ok {\n    p lit.Value\n  }\n  return true\n})"
+	check(t, code, "var v = 1 + 2\n1\n2", "")
+
+	check(t, "format := \"%d-%d\\n\"\nfmt.Printf(format, 1, 2)", "1-2", "")
+}
+
+// ph prints byte slices and arrays in hex, and anything else with %+v
+func TestHexAlias(t *testing.T) {
+	check(t, `ph []byte("gore"), sha256.Sum256(nil)`, "676f7265\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "")
+	check(t, "type digest [2]uint8\nph digest{1, 255}, []byte{}, 42, \"ab\"", "01ff\n\n42\nab", "")
+
+	// encoding/hex is only imported when ph is used
+	if src := eval.Generate("p 1"); strings.Contains(src, "encoding/hex") {
+		t.Errorf("Expected encoding/hex not to be imported. Instead got:\n%s", src)
+	}
+	check(t, "ph hex.EncodeToString([]byte{1})", "01", "")
+}
+
+// an Evaluator's DefaultTimeout bounds the evaluations that don't set a timeout of their own
+func TestEvaluatorDefaultTimeout(t *testing.T) {
+	ev := eval.NewEvaluator()
+	ev.DefaultTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if _, err := ev.Eval("for {}"); !strings.HasPrefix(err, "timeout:") || !strings.HasSuffix(err, " exceeded 100ms") {
+		t.Errorf("Expected a timeout. Instead got %q", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the evaluation to be killed promptly. Took %v", elapsed)
+	}
+	// a timeout of the evaluator's options, or of the call's, takes precedence
+	if out, err := ev.Eval("p 1", eval.WithTimeout(time.Minute)); out != "1\n" || err != "" {
+		t.Errorf("Expected the call's timeout to apply. Instead got out %q, err %q", out, err)
+	}
+	ev = eval.NewEvaluator(eval.WithTimeout(time.Minute))
+	ev.DefaultTimeout = time.Nanosecond
+	if res := ev.EvalResult("p 1"); res.Out != "1\n" || res.Err != "" {
+		t.Errorf("Expected the evaluator's timeout to apply. Instead got %+v", res)
+	}
+	// the call's options don't change the evaluator's
+	ev = eval.NewEvaluator(eval.WithImports(map[string]string{"tpl": "text/template"}))
+	ev.Eval("p 1", eval.WithImports(map[string]string{"yml": "gopkg.in/yaml.v3"}))
+	if _, err := ev.Eval("p yml.Marshal"); !strings.Contains(err, "undefined: yml") {
+		t.Errorf("Expected yml to be unknown. Instead got %q", err)
+	}
+}
+
+// AlwaysImport imports packages whether or not they're inferred, and drops those left unused
+func TestAlwaysImport(t *testing.T) {
+	ev := eval.NewEvaluator(func(o *eval.Options) { o.AlwaysImport = []string{"html/template", "strings"} })
+	// html/template, which escapes its output, rather than the inferred text/template
+	code := "t := template.Must(template.New(\"\").Parse(\"{{.}}\\n\"))\nt.Execute(os.Stdout, \"<b>\")"
+	if out, err := ev.Eval(code); out != "&lt;b&gt;\n" || err != "" {
+		t.Errorf("Expected html/template. Instead got out %q, err %q", out, err)
+	}
+	if out, _ := eval.Eval(code); out != "<b>\n" {
+		t.Errorf("Expected text/template without AlwaysImport. Instead got %q", out)
+	}
+	// unused ones, even if named in a string, don't stop the code from compiling
+	for _, code := range []string{"p 1", "p \"strings\""} {
+		if out, err := ev.Eval(code); out == "" || err != "" {
+			t.Errorf("%q: Expected the unused imports to be dropped. Instead got out %q, err %q", code, out, err)
+		}
+	}
+	_, imports := eval.Explain("p strings.Repeat(\"a\", 2)", func(o *eval.Options) { o.AlwaysImport = []string{"html/template", "strings"} })
+	if fmt.Sprint(imports) != "[strings]" {
+		t.Errorf("Expected only strings to be imported. Instead got %v", imports)
+	}
+}
+
+// evaluators have imports and aliases of their own, and can be used concurrently
+func TestEvaluators(t *testing.T) {
+	imports := map[string]string{"tpl": "text/template"}
+	text := eval.NewEvaluator(eval.WithImports(imports))
+	imports["tpl"] = "os" // doesn't affect text
+	html := eval.NewEvaluator(eval.WithImports(map[string]string{"tpl": "html/template"}), eval.WithTimeout(time.Minute))
+	if err := html.RegisterAlias("pkg", func(args string) string { return "fmt.Println(reflect.TypeOf(" + args + ").PkgPath())" }); err != nil {
+		t.Fatal(err)
+	}
+	if err := text.RegisterAlias("pkg", func(args string) string { return `fmt.Println("text:", reflect.TypeOf(` + args + ").PkgPath())" }); err != nil {
+		t.Fatal(err)
+	}
+	code := "pkg tpl.Template{}"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if out, err := text.Eval(code); out != "text: text/template\n" || err != "" {
+				t.Errorf("Expected text/template. Instead got %q, err %q", out, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if out, err := html.Eval(code); out != "html/template\n" || err != "" {
+				t.Errorf("Expected html/template. Instead got %q, err %q", out, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the package-level functions see neither the imports nor the aliases
+	if _, err := eval.Eval(code); !strings.Contains(err, "syntax error") {
+		t.Errorf("Expected the pkg alias to be unknown. Instead got err %q", err)
+	}
+	if res := html.EvalResult("p tpl.HTMLEscapeString(\"<\")"); res.Out != "&lt;\n" || res.Err != "" {
+		t.Errorf("Expected html/template's escaping. Instead got %q, err %q", res.Out, res.Err)
+	}
+	if out, err := html.NewSession().Eval("pkg tpl.HTML(\"\")"); out != "html/template\n" || err != "" {
+		t.Errorf("Expected the session to use the evaluator's imports and aliases. Instead got %q, err %q", out, err)
+	}
+}
+
+// a registered alias is expanded like the builtin ones
+func TestRegisterAlias(t *testing.T) {
+	err := eval.RegisterAlias("dbl", func(args string) string { return "p 2*(" + args + ")" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { eval.UnregisterAlias("dbl") })
+	eval.RegisterAlias("hex", func(args string) string { return `fmt.Printf("%x\n", ` + args + ")" })
+	t.Cleanup(func() { eval.UnregisterAlias("hex") })
+
+	check(t, "dbl := 4; dbl += 6; hex dbl; if dbl > 1 { hex 255 }\nhex strings.Count(\"aaa\", \"a\")  ", "a\nff\n3", "")
+	// the expansion isn't expanded again
+	check(t, "x := 3; dbl x", "", ":1: syntax error: unexpected literal 2 at end of statement")
+
+	for _, prefix := range []string{"p", "pj", "dbl", "func", "len", "x y", ""} {
+		if err := eval.RegisterAlias(prefix, func(args string) string { return args }); err == nil {
+			t.Errorf("Expected %q to be rejected", prefix)
+		}
+	}
+}
+
+// pr prints without a newline, so that a line can be built up
+func TestPrintNoNewline(t *testing.T) {
+	check(t, `pr "a"; pr "b"
+              for i := 0; i < 3; i++ { pr " ", i }
+              p "!"
+              pr 1, 2, "x", 3`, "ab 0 1 2!\n1 2x3", "")
+}
+
+// pt prints a slice of structs as a table, and anything else with %+v
+func TestPrintTable(t *testing.T) {
+	check(t, `
+         type City struct { Name string; pop int; Coords [2]float64 }
+         cities := []City{{"Oslo", 709000, [2]float64{59.9, 10.7}}, {"Rome", 2873000, [2]float64{41.9, 12.5}}}
+         pt cities, [1]City{}, []City{}
+        `, `Name  pop      Coords
+Oslo  709000   [59.9 10.7]
+Rome  2873000  [41.9 12.5]
+Name  pop  Coords
+      0    [0 0]
+Name  pop  Coords`, "")
+	check(t, `pt 42, []int{1, 2}, map[string]int{"a": 1}, struct{ X int }{7}`, "42\n[1 2]\nmap[a:1]\n{X:7}", "")
+}
+
+// each registered import that doesn't compile is reported
+func TestValidateImports(t *testing.T) {
+	if errs := eval.ValidateImports(); errs != nil {
+		t.Errorf("Expected no errors without imports. Instead got %v", errs)
+	}
+	imports := map[string]string{"js": "encoding/json", "nope": "example.com/no/such/pkg"}
+	errs := eval.ValidateImports(eval.WithImports(imports))
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "nope (example.com/no/such/pkg): ") {
+		t.Errorf("Expected just nope to fail. Instead got %v", errs)
+	}
+}
+
+// a dedicated GOCACHE is filled by compiling the snippet, and GOPATH is set for it too
+func TestGoCacheAndGoPath(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles the runtime into an empty cache")
+	}
+	cache, gopath := t.TempDir(), t.TempDir()
+	out, err := eval.EvalWithOptions(`println(len(os.Getenv("GOPATH")))`, eval.Options{GoCache: cache, GoPath: gopath})
+	if out != fmt.Sprintln(len(gopath)) || err != "" {
+		t.Errorf("Expected the length of %q. Instead got %q, err %q", gopath, out, err)
+	}
+	if entries, _ := os.ReadDir(cache); len(entries) == 0 {
+		t.Errorf("Expected %s to be populated", cache)
+	}
+}
+
+// the output printed before a timeout is returned with the timeout error
+func TestTimeoutKeepsOutput(t *testing.T) {
+	code := "for i := 0; i < 3; i++ {\n  p i\n}\npr \"waiting\"\ntime.Sleep(time.Hour)"
+	for _, mode := range []eval.ExecMode{eval.RunMode, eval.BuildMode} {
+		out, err := eval.EvalWithOptions(code, eval.Options{Timeout: 3 * time.Second, ExecMode: mode})
+		if out != "0\n1\n2\nwaiting" || err != "timeout: execution exceeded 3s" {
+			t.Errorf("Mode %d: Expected the output before the timeout. Instead got out %q, err %q", mode, out, err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := eval.EvalTo(&buf, code, eval.WithTimeout(3*time.Second)); buf.String() != "0\n1\n2\nwaiting" || !strings.HasPrefix(err, "timeout:") {
+		t.Errorf("Expected the streamed output before the timeout. Instead got %q, err %q", buf.String(), err)
+	}
+}
+
+// a timeout says which phase it cut short, where that's known
+func TestTimeoutPhase(t *testing.T) {
+	tests := []struct{ phase, printed, want string }{
+		{eval.PhaseCompiling, "", "timeout: compilation exceeded 1s"},
+		{eval.PhaseRunning, "", "timeout: execution exceeded 1s"},
+		{"", "started\n", "timeout: execution exceeded 1s"}, // go run, once the code has printed
+		{"", "", "timeout: evaluation exceeded 1s"},         // go run, which may still be compiling
+	}
+	for _, test := range tests {
+		if got := eval.TimeoutError(eval.TimeoutPhase(test.phase, test.printed), time.Second); got != test.want {
+			t.Errorf("%q, %q: Expected %q. Instead got %q", test.phase, test.printed, test.want, got)
+		}
+	}
+	_, err := eval.EvalWithOptions("for {}", eval.Options{Timeout: 2 * time.Second, ExecMode: eval.BuildMode})
+	if err != "timeout: execution exceeded 2s" {
+		t.Errorf("Expected an execution timeout. Instead got %q", err)
+	}
+}
+
+// the generated files are removed even when the evaluation is killed
+func TestTempFilesRemovedOnTimeout(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	for _, mode := range []eval.ExecMode{eval.RunMode, eval.BuildMode} {
+		res := eval.EvalResult(`p "start"; for {}`, eval.Options{Timeout: 2 * time.Second, ExecMode: mode})
+		if !strings.HasPrefix(res.Err, "timeout") {
+			t.Errorf("Expected a timeout. Instead got %+v", res)
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "gore_eval*")); len(left) != 0 {
+		t.Errorf("Expected no generated files to remain. Instead found %v", left)
+	}
+}
+
+// RemoveTempFiles removes gore's leftovers, and only those
+func TestRemoveTempFiles(t *testing.T) {
+	dir, module := t.TempDir(), t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	os.WriteFile(filepath.Join(dir, "other.go"), nil, 0600)
+	os.WriteFile(filepath.Join(module, "go.mod"), []byte("module example.com/m\n"), 0600)
+	binary, err := eval.Compile("p 1")
+	if err != "" {
+		t.Fatal(err)
+	}
+	inModule := func(o *eval.Options) { o.ModuleDir = module }
+	var sessions []*eval.Session
+	for _, opts := range [][]eval.Option{nil, {inModule}} {
+		s := eval.NewSession(opts...)
+		if _, err := s.Eval("p 1"); err != "" {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+	os.Mkdir(filepath.Join(dir, "gore_eval_cover_1"), 0700) // as if the process had been killed
+	if hidden, _ := filepath.Glob(filepath.Join(module, ".gore_eval*")); len(hidden) != 1 {
+		t.Fatalf("Expected the module session's directory. Instead found %v", hidden)
+	}
+
+	if err := eval.RemoveTempFiles(inModule); err != nil {
+		t.Errorf("Expected no error. Instead got %v", err)
+	}
+	for _, d := range []string{dir, module} {
+		entries, _ := os.ReadDir(d)
+		var left []string
+		for _, e := range entries {
+			left = append(left, e.Name())
+		}
+		if want := map[string]string{dir: "[other.go]", module: "[go.mod]"}[d]; fmt.Sprint(left) != want {
+			t.Errorf("Expected %s to hold %s. Instead found %v", d, want, left)
+		}
+	}
+	if _, e := os.Stat(binary); !os.IsNotExist(e) {
+		t.Errorf("Expected the compiled binary to be removed")
+	}
+	// again, with nothing to remove, and with the sessions still to be closed
+	if err := eval.RemoveTempFiles(inModule); err != nil {
+		t.Errorf("Expected no error the second time. Instead got %v", err)
+	}
+	for _, s := range sessions {
+		s.Close()
+	}
+}
+
+// generic declarations, type parameters and all, go to the top level; their uses stay in main
+func TestGenerics(t *testing.T) {
+	code := `
+          func Map[T, U any](s []T, f func(T) U) []U {
+            r := make([]U, 0, len(s))
+            for _, v := range s { r = append(r, f(v)) }
+            return r
+          }
+          type Pair[K comparable, V any] struct { Key K; Val V }
+          m := Map([]int{1,2,3}, func(x int)int{return x*2})
+          p m, Pair[string, []int]{"m", m}
+         `
+	topLevel, nonTopLevel, _, _, err := eval.Partition(code, eval.BuiltinPkgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"func Map[T, U any]", "return r", "type Pair[K comparable, V any]"} {
+		if !strings.Contains(topLevel, s) || strings.Contains(nonTopLevel, s) {
+			t.Errorf("Expected %q at top level. Instead got top level:\n%s\nmain:\n%s", s, topLevel, nonTopLevel)
+		}
+	}
+	if !strings.Contains(nonTopLevel, "m := Map(") {
+		t.Errorf("Expected the call to Map in main. Instead got:\n%s", nonTopLevel)
+	}
+	check(t, code, "[2 4 6]\n{Key:m Val:[2 4 6]}", "")
+}
+
+// the explanation of the README's example is the program in testdata/explain.golden
+func TestExplain(t *testing.T) {
+	code := `
+ p "Making a point"
+ type Point struct {
+    x,y int
+ }
+ v := Point{10, 100}
+ // and its distance from the origin
+ p v, math.Hypot(3, 4)
+`
+	golden, err := os.ReadFile(filepath.Join("testdata", "explain.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, imports := eval.Explain(code)
+	if src != string(golden) || fmt.Sprint(imports) != "[math]" {
+		t.Errorf("Expected the source in testdata/explain.golden, importing [math]. Instead got %v\n%s", imports, src)
+	}
+	check(t, src, "Making a point\n{x:10 y:100}\n5\n", "")
+}
+
+// deeply indented declarations keep their line numbers, and Explain lays them out as gofmt does
+func TestIndentedDeclarations(t *testing.T) {
+	code := "\t\t\t\ttype T struct {\n\t\t\t\t\t\tn int\n\t\t\t\t}\n" +
+		"            func (t T) double() int {\n" +
+		"                    return t.n * 2\n" +
+		"                      }\n" +
+		"\t\t\t  v := T{21}\n" +
+		"      \t\tp v.double()"
+	gen := eval.Generate(code)
+	for _, line := range strings.Split(gen, "\n") {
+		if strings.Contains(line, "//line") && !strings.HasPrefix(line, "//line :") {
+			t.Errorf("Expected each line directive at the start of a line. Instead got %q in:\n%s", line, gen)
+		}
+	}
+	check(t, code, "42", "")
+	check(t, strings.Replace(code, "t.n * 2", "t.m * 2", 1), "", ":5: t.m undefined (type T has no field or method m)")
+
+	src, _ := eval.Explain(code)
+	want := "type T struct {\n\tn int\n}\n\nfunc (t T) double() int {\n\treturn t.n * 2\n}\n\nfunc main() {\n\tv := T{21}\n\t__p(v.double())\n}\n"
+	if !strings.Contains(src, want) {
+		t.Errorf("Expected the declarations reindented. Instead got:\n%s", src)
+	}
+}
+
+// code pasted from gofmt output, indented with tabs, is partitioned as if it weren't indented
+func TestTabIndentedCode(t *testing.T) {
+	code := "\timport \"strings\"\n\ttype shout string\n\tfunc (s shout) String() string {\n\t\treturn strings.ToUpper(string(s))\n\t}\n\tvar s shout = \"hi\"\n\tp s"
+	topLevel, nonTopLevel, _, _, err := eval.Partition(code, eval.BuiltinPkgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range []string{"import \"strings\"", "type shout string", "func (s shout) String() string {"} {
+		if !strings.Contains(topLevel, decl) || strings.Contains(nonTopLevel, decl) {
+			t.Errorf("Expected %q at the top level. Instead got:\n%s\n--\n%s", decl, topLevel, nonTopLevel)
+		}
+	}
+	check(t, code, "HI", "")
+	check(t, "\tfunc f() int {\n\t\treturn 1\n\t}\n\tp f(), math.Sqrt(4)", "1\n2", "")
+	check(t, "\n\tpackage main\n\n\timport \"fmt\"\n\n\tfunc main() {\n\t\tfmt.Println(\"whole program\")\n\t}", "whole program", "")
+	check(t, " \t package\tmain\n\tfunc main() { println() }", "\n", "")
+}
+
+// the build cache status comes from the commands printed by go build -x
+func TestCacheHit(t *testing.T) {
+	miss := `WORK=/tmp/go-build1092978452
+mkdir -p $WORK/b002/
+cat >/tmp/go-build1092978452/b002/importcfg << 'EOF' # internal
+# import config
+packagefile errors=/root/.cache/go-build/5b/5b3c-d
+EOF
+cd /usr/local/go/src/fmt
+/usr/local/go/pkg/tool/linux_amd64/compile -o $WORK/b002/_pkg_.a -trimpath "$WORK/b002=>" -p fmt -lang=go1.27 -std -complete -pack ./doc.go ./errors.go ./format.go
+cd /tmp
+/usr/local/go/pkg/tool/linux_amd64/compile -o $WORK/b001/_pkg_.a -trimpath "$WORK/b001=>" -p main -lang=go1.27 -complete -pack ./gore_eval_1.go
+/usr/local/go/pkg/tool/linux_amd64/link -o $WORK/b001/exe/a.out -importcfg $WORK/b001/importcfg.link -buildmode=exe $WORK/b001/_pkg_.a
+mv $WORK/b001/exe/a.out /tmp/gore_eval_1
+rm -rf $WORK/b001/
+`
+	hit := "WORK=/tmp/go-build1\ncd /tmp\n/usr/local/go/pkg/tool/linux_amd64/compile -o $WORK/b001/_pkg_.a -p main -complete -pack ./gore_eval_2.go\n"
+	if eval.IsCacheHit([]byte(miss)) || !eval.IsCacheHit([]byte(hit)) || !eval.IsCacheHit([]byte("WORK=/tmp/go-build2649715952\n")) {
+		t.Errorf("Expected only a build that compiles a dependency to be a cache miss")
+	}
+
+	eval.Eval("p 1")
+	if res := eval.EvalResult("p 2", eval.Options{CacheDiagnostics: true}); res.Out != "2\n" || !res.CacheHit {
+		t.Errorf("Expected fmt to be cached. Instead got %+v", res)
+	}
+	if res := eval.EvalResult("p x", eval.Options{CacheDiagnostics: true}); res.Err != ":1: undefined: x\n" || res.CacheHit {
+		t.Errorf("Expected the compile error. Instead got %+v", res)
+	}
+}
+
+// compile and run times are reported separately in BuildMode
+func TestDurations(t *testing.T) {
+	code := "time.Sleep(100 * time.Millisecond)"
+	res := eval.EvalResult(code, eval.Options{ExecMode: eval.BuildMode})
+	if res.Err != "" || res.CompileDuration <= 0 || res.RunDuration < 100*time.Millisecond {
+		t.Errorf("BuildMode: Expected both durations, got compile %v, run %v (err %q)", res.CompileDuration, res.RunDuration, res.Err)
+	}
+	res = eval.EvalResult(code, eval.Options{})
+	if res.Err != "" || res.CompileDuration != 0 || res.RunDuration < 100*time.Millisecond {
+		t.Errorf("RunMode: Expected only a run duration, got compile %v, run %v (err %q)", res.CompileDuration, res.RunDuration, res.Err)
+	}
+}
+
+// temp files are named after TempPrefix, and removed afterwards
+func TestTempPrefix(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	code := `
+        entries, _ := os.ReadDir(os.Getenv("TMPDIR"))
+        for _, e := range entries {
+            if strings.HasSuffix(e.Name(), ".go") {
+                p strings.HasPrefix(e.Name(), "mytool_"), len(e.Name()) > len("mytool_.go")
+            }
+        }
+        p strings.HasPrefix(filepath.Base(os.Args[0]), "mytool_")
+        `
+	for _, mode := range []eval.ExecMode{eval.RunMode, eval.BuildMode} {
+		out, err := eval.EvalWithOptions(code, eval.Options{TempPrefix: "mytool", ExecMode: mode})
+		if err != "" || !strings.HasPrefix(out, "true\ntrue\n") {
+			t.Errorf("Mode %d: Expected the temp file to be named mytool_<random>.go. Instead got out %q, err %q", mode, out, err)
+		}
+	}
+	if out, _ := eval.EvalWithOptions(code, eval.Options{ExecMode: eval.BuildMode}); out != "false\ntrue\nfalse\n" {
+		t.Errorf("Expected the default prefix. Instead got out %q", out)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(dir, "*_*")); len(entries) != 0 {
+		t.Errorf("Expected the temp files to be removed. Found %v", entries)
+	}
+}
+
+// generated code falls back from $TMPDIR to $TEMPDIR to the OS temp dir, if unwritable
+func TestTempDirFallback(t *testing.T) {
+	tmpdir, tempdir, osdir := t.TempDir(), t.TempDir(), t.TempDir()
+	env := map[string]string{"TMPDIR": tmpdir, "TEMPDIR": tempdir}
+	unwritable := map[string]bool{}
+	restore := eval.SetFileOps(func(key string) string { return env[key] }, func() string { return osdir },
+		func(dir, pattern string) (*os.File, error) {
+			if unwritable[dir] {
+				return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrPermission}
+			}
+			return os.CreateTemp(dir, pattern)
+		})
+	defer restore()
+
+	savedIn := func() string {
+		tmpfile := eval.Save("", "gore_eval", "package main\n")
+		defer os.Remove(tmpfile)
+		return filepath.Dir(tmpfile)
+	}
+	if dir := savedIn(); dir != tmpdir {
+		t.Errorf("Expected the file in $TMPDIR, %s. Instead got %s", tmpdir, dir)
+	}
+	unwritable[tmpdir] = true
+	if dir := savedIn(); dir != tempdir {
+		t.Errorf("Expected the file in $TEMPDIR, %s. Instead got %s", tempdir, dir)
+	}
+	unwritable[tempdir] = true
+	if dir := savedIn(); dir != osdir {
+		t.Errorf("Expected the file in the OS temp dir, %s. Instead got %s", osdir, dir)
+	}
+	check(t, "p 1", "1", "")
+
+	// the error reported is for the first choice
+	unwritable[osdir] = true
+	if _, err := eval.Eval("p 1"); !strings.Contains(err, tmpdir) || !strings.Contains(err, "permission denied") {
+		t.Errorf("Expected an error about %s. Instead got %q", tmpdir, err)
+	}
+
+	delete(env, "TMPDIR")
+	env["TEMPDIR"] = osdir
+	if dirs := eval.TempDirs(); len(dirs) != 1 || dirs[0] != osdir {
+		t.Errorf("Expected unset and repeated dirs to be skipped. Instead got %v", dirs)
+	}
+}
+
+// a file that can't be written is removed, rather than left half-written
+func TestSaveWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	restore := eval.SetFileOps(nil, nil, func(dir, pattern string) (*os.File, error) {
+		fh, err := os.CreateTemp(dir, pattern)
+		if err == nil {
+			fh.Close() // so that writes fail
+		}
+		return fh, err
+	})
+	defer restore()
+
+	defer func() {
+		if e := recover(); e == nil || !strings.Contains(fmt.Sprint(e), "Unable to write") {
+			t.Errorf("Expected a panic about the write. Instead got %v", e)
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Errorf("Expected the file to be removed. Instead found %v", files)
+		}
+	}()
+	eval.Save(dir, "gore_eval", "package main\n")
+}
+
+// a symbol only html/template has switches "template" from text/template
+func TestAlternatePackage(t *testing.T) {
+	check(t, `p template.HTMLEscapeString("<b>")`, "&lt;b&gt;", "")
+	check(t, `var h template.HTML = "<b>"; p h`, "<b>", "")
+
+	code := `
+        var h template.HTML = "<b>"
+        t := template.Must(template.New("t").Parse("{{.}}"))
+        t.Execute(os.Stdout, h)
+        t.Execute(os.Stdout, "<i>")
+        `
+	check(t, code, "<b>&lt;i&gt;", "")
+
+	// the inferred package is kept if the alternatives don't help
+	check(t, "template.NoSuchThing()", "", ":1: undefined: template.NoSuchThing")
+}
+
+// EvalOK is false for any kind of failure
+func TestEvalOK(t *testing.T) {
+	tests := []struct {
+		code string
+		ok   bool
+	}{
+		{`p "fine"`, true},
+		{"", true},
+		{"p x", false},
+		{`panic("boom")`, false},
+		{"os.Exit(3)", false},
+		{"for {}", false},
+	}
+	for _, test := range tests {
+		if ok := eval.EvalOK(test.code, eval.WithTimeout(2*time.Second)); ok != test.ok {
+			t.Errorf("Expected EvalOK(%q) to be %v", test.code, test.ok)
+		}
+	}
+}
+
+// EvalExpect ignores surrounding whitespace, and reports mismatches as a diff
+func TestEvalExpect(t *testing.T) {
+	code := "p \"Eval demo\"\nfor i := 1; i <= 3; i++ {\n  p i\n}"
+	if err := eval.EvalExpect(code, "\n  Eval demo\r\n1\n2\n3"); err != nil {
+		t.Errorf("Expected a match. Instead got %v", err)
+	}
+
+	expected := "unexpected output:\n  Eval demo\n  1\n- two\n+ 2\n  3\n+ 4\n"
+	if err := eval.EvalExpect(code+"\np 4", "Eval demo\n1\ntwo\n3"); err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q. Instead got %v", expected, err)
+	}
+
+	err := eval.EvalExpect("p x", "")
+	if err == nil || !strings.Contains(err.Error(), ":1: undefined: x") {
+		t.Errorf("Expected the compile error. Instead got %v", err)
+	}
+}
+
+// EvalExpectError passes only if the snippet fails with the expected error
+func TestEvalExpectError(t *testing.T) {
+	for code, substr := range map[string]string{
+		"x := 1\np y":                         ":2: undefined: y",
+		"var s string = 1":                    "cannot use 1",
+		"a := []int{}\np a[1]":                "index out of range",
+		"fmt.Print(\"a\\r\\nb\")\nos.Exit(1)": "exit status 1",
+	} {
+		if err := eval.EvalExpectError(code, substr); err != nil {
+			t.Errorf("%q: Expected an error with %q. Instead got %v", code, substr, err)
+		}
+	}
+
+	err := eval.EvalExpectError("p 1 + 1", "undefined")
+	if err == nil || err.Error() != "evaluation succeeded, with output:\n2\n" {
+		t.Errorf("Expected the snippet's success to be reported. Instead got %v", err)
+	}
+	err = eval.EvalExpectError("p y", "mismatched types")
+	if err == nil || err.Error() != "expected an error containing \"mismatched types\". Instead got:\n:1: undefined: y\n" {
+		t.Errorf("Expected the other error to be reported. Instead got %v", err)
+	}
+}
 
 func check(t *testing.T, code string, expected_out string, expected_err string) {
 	out, err := eval.Eval(code)
@@ -0,0 +1,82 @@
+package eval
+
+import (
+	"io"
+	"time"
+)
+
+// An Evaluator evaluates snippets with options of its own, and with aliases of its own
+// rather than those added with the package-level RegisterAlias. Evaluators don't share
+// any state, so that, say, two plugins of a host can each import "yaml" from a different
+// module, or register a "dump" alias of their own:
+//
+//	ev := eval.NewEvaluator(eval.WithImports(map[string]string{"yaml": "gopkg.in/yaml.v3"}))
+//	ev.RegisterAlias("dump", func(args string) string { return "spew.Dump(" + args + ")" })
+//	out, err := ev.Eval(code)
+//
+// An Evaluator is safe for concurrent use, once configured. The package-level functions,
+// such as Eval, behave as an Evaluator created with the options they're given, but
+// sharing the aliases added with RegisterAlias.
+type Evaluator struct {
+	// DefaultTimeout bounds each evaluation whose options (those of NewEvaluator, and then
+	// those of the call) don't set a Timeout. Zero means evaluations are unbounded, which
+	// is a bad idea for a server evaluating untrusted snippets.
+	DefaultTimeout time.Duration
+
+	opts    Options
+	aliases aliasRegistry
+}
+
+// NewEvaluator creates an Evaluator that evaluates snippets with the given options
+func NewEvaluator(opts ...Option) *Evaluator {
+	ev := &Evaluator{opts: NewOptions(opts...)}
+	if ev.opts.Imports != nil { // so that changes to the caller's map don't affect ev
+		ev.opts.Imports = NewOptions(WithImports(ev.opts.Imports)).Imports
+	}
+	ev.opts.aliases = &ev.aliases
+	return ev
+}
+
+// RegisterAlias is the package-level RegisterAlias, but the alias is expanded only in
+// snippets evaluated by ev
+func (ev *Evaluator) RegisterAlias(prefix string, expand func(args string) string) error {
+	return ev.aliases.register(prefix, expand)
+}
+
+// Eval is the package-level Eval, with ev's options and aliases. opts are applied on top
+// of ev's, for this call only.
+func (ev *Evaluator) Eval(code string, opts ...Option) (out string, err string) {
+	return EvalWithOptions(code, ev.options(opts))
+}
+
+// EvalResult is the package-level EvalResult, with ev's options (and then opts) and aliases
+func (ev *Evaluator) EvalResult(code string, opts ...Option) Result {
+	return EvalResult(code, ev.options(opts))
+}
+
+// EvalTo is the package-level EvalTo, with ev's options (and then opts) and aliases
+func (ev *Evaluator) EvalTo(w io.Writer, code string, opts ...Option) (err string) {
+	options := ev.options(opts)
+	options.output = w
+	return EvalResult(code, options).Err
+}
+
+// NewSession creates a Session that evaluates snippets with ev's options and aliases
+func (ev *Evaluator) NewSession() *Session {
+	return &Session{opts: ev.options(nil)}
+}
+
+// ev's options with opts applied, and DefaultTimeout if they leave Timeout unset
+func (ev *Evaluator) options(opts []Option) Options {
+	options := ev.opts
+	if len(opts) > 0 && options.Imports != nil { // so that WithImports doesn't change ev's
+		options.Imports = NewOptions(WithImports(options.Imports)).Imports
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.Timeout == 0 {
+		options.Timeout = ev.DefaultTimeout
+	}
+	return options
+}
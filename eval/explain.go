@@ -0,0 +1,50 @@
+package eval
+
+import (
+	"go/format"
+	"regexp"
+	"sort"
+)
+
+// the line directives that map the generated code back to the snippet's lines
+var lineDirectivePat = regexp.MustCompile(`(?m)^//line :\d+\n`)
+
+// Explain shows the Go program that a snippet turns into, for those learning what the
+// shorthand stands for: aliases expanded, the snippet wrapped in a main function, and
+// the inferred imports added. The source is gofmt'd, keeps the snippet's comments, and
+// leaves out the line directives that are only there for error messages. imports lists
+// the inferred import paths, sorted.
+//
+// The source is as first compiled; it doesn't reflect imports that Eval repairs after
+// a compilation error. A snippet with a package clause is its own explanation, and one
+// that can't be partitioned is returned as is.
+func Explain(code string, opts ...Option) (generatedSource string, imports []string) {
+	if hasPackageClause(code) {
+		return gofmt(code), nil
+	}
+	options := NewOptions(opts...)
+	code = expandAliases(code, options.customAliases())
+	if options.AutoCheckErr {
+		code = insertErrChecks(code)
+	}
+	topLevel, nonTopLevel, pkgsToImport, _, err := partition(code, options.knownPkgs())
+	if err != nil {
+		return code, nil
+	}
+	options.addAlwaysImports(topLevel+nonTopLevel, pkgsToImport)
+	for path := range pkgsToImport {
+		imports = append(imports, path)
+	}
+	sort.Strings(imports)
+	src := lineDirectivePat.ReplaceAllString(buildMain(topLevel, nonTopLevel, pkgsToImport), "")
+	return gofmt(src), imports
+}
+
+// src, gofmt'd unless it doesn't parse
+func gofmt(src string) string {
+	formatted, err := format.Source([]byte(src))
+	if err != nil {
+		return src
+	}
+	return string(formatted)
+}
@@ -0,0 +1,60 @@
+package eval
+
+import "os"
+
+// Exported for tests only
+var (
+	InferPackages         = inferPackages
+	Partition             = partition
+	AnnotateUnusedImports = annotateUnusedImports
+	BuildMain             = buildMain
+	IsCacheHit            = isCacheHit
+	SplitToolchainOutput  = splitToolchainOutput
+	FormatErrors          = formatErrors
+	TimeoutPhase          = timeoutPhase
+	TimeoutError          = timeoutError
+)
+
+var (
+	Save     = save
+	TempDirs = tempDirs
+)
+
+// Replace the file operations used for temp files, until the returned func is called.
+// A nil func leaves the operation as is.
+func SetFileOps(env func(string) string, osDir func() string, create func(dir, pattern string) (*os.File, error)) (restore func()) {
+	oldEnv, oldDir, oldCreate := getenv, osTempDir, createTemp
+	if env != nil {
+		getenv = env
+	}
+	if osDir != nil {
+		osTempDir = osDir
+	}
+	if create != nil {
+		createTemp = create
+	}
+	return func() { getenv, osTempDir, createTemp = oldEnv, oldDir, oldCreate }
+}
+
+// Undo RegisterAlias
+func UnregisterAlias(prefix string) {
+	customAliases.Lock()
+	defer customAliases.Unlock()
+	for i, a := range customAliases.list {
+		if a.prefix == prefix {
+			customAliases.list = append(customAliases.list[:i], customAliases.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// A func, as builtinPkgs is only populated by init()
+func BuiltinPkgs() map[string]string {
+	return builtinPkgs
+}
+
+// The code generated for a snippet, as it is first compiled
+func Generate(code string) string {
+	topLevel, nonTopLevel, pkgsToImport, _, _ := partition(expandAliases(code, nil), builtinPkgs)
+	return buildMain(topLevel, nonTopLevel, pkgsToImport)
+}
@@ -0,0 +1,85 @@
+package eval
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// marks the output lines that carry the values of inspected variables
+const inspectMarker = "\x00gore:inspect:"
+
+// EvalAndInspect is Eval, but also returns the final values of the named variables,
+// as formatted by "%+v". The variables are inspected at the end of the snippet's
+// main function, so they must be in scope there. A variable that isn't has no entry
+// in values, and is reported in err as "inspect: undefined: name". The values are
+// printed on marked lines, which are stripped from out.
+func EvalAndInspect(code string, vars []string, opts ...Option) (out string, values map[string]string, err string) {
+	if hasPackageClause(code) {
+		out, err = Eval(code, opts...)
+		return out, nil, err + "inspect: not supported for snippets with a package declaration\n"
+	}
+
+	// The inspecting calls go on lines after the snippet, so as not to disturb its line
+	// numbers, and so that errors about them can be identified
+	firstLine := strings.Count(code, "\n") + 2
+	var missing []string
+	for {
+		src := code + "\n"
+		for _, v := range vars {
+			src += fmt.Sprintf("__inspect(%q, %s)\n", v, v)
+		}
+		src += `func __inspect(name string, v interface{}) {
+	fmt.Printf("` + strings.Replace(inspectMarker, "\x00", `\x00`, 1) + `%s:%q\n", name, fmt.Sprintf("%+v", v))
+}`
+		out, err = Eval(src, opts...)
+		undefined := undefinedInspections(err, vars, firstLine)
+		if len(undefined) == 0 {
+			break
+		}
+		// Drop the variables that don't exist and try again
+		var defined []string
+		for _, v := range vars {
+			if !undefined[v] {
+				defined = append(defined, v)
+			}
+		}
+		for v := range undefined {
+			missing = append(missing, v)
+		}
+		vars = defined
+	}
+
+	values = make(map[string]string)
+	var lines []string
+	for _, line := range strings.SplitAfter(out, "\n") {
+		if !strings.HasPrefix(line, inspectMarker) {
+			lines = append(lines, line)
+			continue
+		}
+		nameValue := strings.SplitN(strings.TrimSpace(line[len(inspectMarker):]), ":", 2)
+		if len(nameValue) == 2 {
+			values[nameValue[0]], _ = strconv.Unquote(nameValue[1])
+		}
+	}
+	for _, v := range missing {
+		err += "inspect: undefined: " + v + "\n"
+	}
+	return strings.Join(lines, ""), values, err
+}
+
+var undefinedPat = regexp.MustCompile(`(?m)^:(\d+): undefined: (\w+)`)
+
+// The inspected variables that the compiler reports as undefined on the lines of the
+// inspecting calls, which start at firstLine
+func undefinedInspections(err string, vars []string, firstLine int) (undefined map[string]bool) {
+	undefined = make(map[string]bool)
+	for _, m := range undefinedPat.FindAllStringSubmatch(err, -1) {
+		line, _ := strconv.Atoi(m[1])
+		if i := line - firstLine; i >= 0 && i < len(vars) && vars[i] == m[2] {
+			undefined[m[2]] = true
+		}
+	}
+	return undefined
+}
@@ -0,0 +1,103 @@
+package eval
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// EvalLines is EvalTo, but passes each line of output to fn as it is produced, along with
+// the line of the snippet that printed it, so that a UI can show the two side by side:
+//
+//	eval.EvalLines("x := 2\np x\np x*x", func(line int, text string) {
+//		fmt.Printf("%d: %s\n", line, text) // prints 2: 2, then 3: 4
+//	})
+//
+// For now, only the output of "p" statements is attributed; for other output (and that of
+// a "p" statement in a func declared in the snippet, which is attributed to the line of
+// the call) line is 0. A final line with no trailing newline is passed on as well.
+func EvalLines(code string, fn func(line int, text string), opts ...Option) (err string) {
+	options := NewOptions(opts...)
+	w := &lineWriter{fn: fn}
+	options.output = w
+	options.attributeLines = true
+	err = EvalResult(code, options).Err
+	w.flush()
+	return err
+}
+
+// precedes each line printed by the attributing __p, as lineMarker + "12\x00"
+const lineMarker = "\x00gore:line:"
+
+// Replace the __p helper in generated code with one that marks each line it prints with
+// the snippet line it was called from. The "//line" directives in the generated code make
+// that the line runtime.Caller reports.
+func attributeLines(src string) string {
+	if !strings.Contains(src, "\nfunc __p(") {
+		return src
+	}
+	src = strings.Replace(src, pHelper(), `
+func __p(values ...interface{}){
+	_, _, line, _ := __runtime.Caller(1)
+	for _, v := range values {
+		for _, s := range __strings.Split(__fmt.Sprintf("%+v", v), "\n") {
+			__fmt.Printf("`+strings.Replace(lineMarker, "\x00", `\x00`, 1)+`%d\x00%s\n", line, s)
+		}
+	}
+}
+`, 1)
+	// The imports precede the first "//line" directive, so the snippet's lines are unaffected
+	return strings.Replace(src, "package main\n", "package main\nimport __runtime \"runtime\"\nimport __strings \"strings\"\n", 1)
+}
+
+// The source of the plain __p helper
+func pHelper() string {
+	for _, h := range optionalHelpers {
+		if h.name == "__p" {
+			return h.src
+		}
+	}
+	panic("no __p helper")
+}
+
+// Passes each line written to it to fn, without the marker, if any, that names the snippet
+// line it came from. exec.Cmd doesn't call Write concurrently for a writer shared by
+// stdout and stderr, so there's no locking.
+type lineWriter struct {
+	fn      func(line int, text string)
+	partial []byte
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.partial = append(w.partial, b...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+// Pass on a final line that has no newline
+func (w *lineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.emit(string(w.partial))
+		w.partial = nil
+	}
+}
+
+func (w *lineWriter) emit(text string) {
+	line := 0
+	// The marker follows any output printed without a newline just before
+	if i := strings.Index(text, lineMarker); i >= 0 {
+		rest := text[i+len(lineMarker):]
+		if end := strings.IndexByte(rest, 0); end >= 0 {
+			line, _ = strconv.Atoi(rest[:end])
+			text = text[:i] + rest[end+1:]
+		}
+	}
+	w.fn(line, text)
+}
@@ -0,0 +1,312 @@
+package eval
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Options tweak how Eval compiles and runs a snippet. The zero value gives the
+// default behaviour.
+type Options struct {
+	// Timeout bounds the time taken to compile and run the snippet. The subprocess is
+	// killed once it expires, and a timeout error is returned, along with whatever it had
+	// printed by then. The error says whether compilation or execution took too long, as
+	// far as is known: in RunMode, only code that printed something is known to have run.
+	// Zero means no timeout.
+	Timeout time.Duration
+	// SuppressCompileOutput drops compiler diagnostics and warnings from the result. A
+	// snippet that fails to compile reports just "compilation failed".
+	SuppressCompileOutput bool
+	// SuppressRunOutput drops the output of the evaluated program from the result.
+	SuppressRunOutput bool
+	// ValidUTF8 replaces each run of bytes in the output (and errors) that isn't valid
+	// UTF-8 with the replacement character U+FFFD, for front-ends that need valid text,
+	// such as JSON encoders. By default, the output is returned as the program wrote it.
+	ValidUTF8 bool
+	// Vet runs "go vet" over the generated code once it compiles, and reports its
+	// findings as warnings.
+	Vet bool
+	// VetAsError runs "go vet" over the generated code before running it, and if it finds
+	// anything, reports that as an error instead of running the code.
+	VetAsError bool
+	// ShowAllErrors has the compiler report every error, if it stopped after the first ten
+	// with "too many errors", by compiling again with -gcflags=-e.
+	ShowAllErrors bool
+	// DenyImports lists packages that the code may not import, whether explicitly or by
+	// inference, as a first line of defense for a public playground (it is no sandbox).
+	// An entry ending in "/..." denies the packages under it as well. A snippet that
+	// imports one is reported as a compile error, and isn't compiled.
+	DenyImports []string
+	// Coverage builds the code with coverage instrumentation (implying BuildMode), and
+	// reports in Result.Coverage how many times each line of the snippet ran.
+	Coverage bool
+	// CatchPanics recovers from a panic in the snippet's statements (but not in goroutines
+	// it starts), and reports it as "panic: <value>", followed by "\tat line N" with the
+	// line of the snippet that panicked, rather than with the full goroutine trace. The
+	// program then exits with status 2, as it would have.
+	CatchPanics bool
+	// StderrPrefix, if set, is put before each line that the code writes to stderr, to tell
+	// those from the lines written to stdout in the combined output. The two are read
+	// from separate pipes, so lines written to both at about the same time may be out of
+	// order. This implies BuildMode, as compiler errors aren't tagged, and is ignored with
+	// PseudoTTY. Neither are the panic and exit status reported in Result.Err.
+	StderrPrefix string
+	// SeparateStderr returns what the code writes to stderr (such as the output of the log
+	// package) in Result.Stderr, rather than along with its stdout in Out, whether or not
+	// it succeeds. Like StderrPrefix, which it overrides, this implies BuildMode and is
+	// ignored with PseudoTTY. EvalTo ignores it, and streams both.
+	SeparateStderr bool
+	// GoDebug, e.g. "gctrace=1", sets GODEBUG for the code (but not for the go tool, which
+	// would otherwise trace itself), to observe the runtime's behaviour. It implies BuildMode
+	// and SeparateStderr, so that the diagnostics the runtime writes to stderr are returned
+	// in Result.Stderr rather than mixed into the output.
+	GoDebug string
+	// Profile has the code profiled, with runtime/pprof, and the profile returned in
+	// Result.Profile: CPUProfile covers the whole run, and HeapProfile is taken as the
+	// snippet's statements return. Either implies BuildMode. A run that ends with os.Exit
+	// (or a fatal error) has no profile, nor does a snippet with a package clause.
+	Profile ProfileKind
+	// PseudoTTY runs the code with its stdout and stderr connected to a pseudo-terminal
+	// rather than a pipe, for programs that behave differently on a terminal (with colors,
+	// say, or progress bars). Only supported on Linux; elsewhere, it is ignored.
+	PseudoTTY bool
+	// ExecMode selects between "go run" (the default) and running a separately built binary.
+	ExecMode ExecMode
+	// CacheDiagnostics reports in Result.CacheHit whether the packages imported by the
+	// code came from the go build cache, to help diagnose slow evaluations. It implies
+	// BuildMode, and costs a second build if the code doesn't compile.
+	CacheDiagnostics bool
+	// ModuleDir, if set, is the root of a module that the snippet is compiled and run in,
+	// so that it can import that module's packages. The generated code is placed in a
+	// temporary subdirectory of ModuleDir, which is removed afterwards. The toolchain
+	// is never switched, even if the module asks for a newer go.
+	ModuleDir string
+	// GoBinary is the go tool used to compile the snippet. Defaults to "go" on the PATH.
+	GoBinary string
+	// GoCache and GoPath, if set, are the GOCACHE and GOPATH for compiling and running the
+	// snippet, so that it neither uses nor fills the user's own build and module caches.
+	// They should be absolute paths. By default, both are inherited.
+	GoCache string
+	GoPath  string
+	// Imports maps package names to import paths, in addition to the standard packages
+	// that are inferred by default, e.g. {"yaml": "gopkg.in/yaml.v3"}. An entry for a
+	// standard package's name overrides it.
+	Imports map[string]string
+	// AlwaysImport lists import paths that are imported whether or not they're inferred,
+	// taking precedence over an inferred package of the same name: {"html/template"}, say,
+	// for snippets that would otherwise get text/template. The name is the one Imports
+	// gives the path, or else its last element. A package whose name the snippet doesn't
+	// use is left out, as it would fail to compile.
+	AlwaysImport []string
+	// AutoCheckErr follows each "v, err := ..." statement with "if err != nil { p err }",
+	// so that an error that isn't otherwise checked is printed rather than flagged as
+	// declared and not used. This changes what the snippet does, so it is off by default.
+	AutoCheckErr bool
+	// GOMAXPROCS, if positive, is set in the environment of the compiled program
+	GOMAXPROCS int
+	// GoExperiment, e.g. "loopvar", is set as GOEXPERIMENT for compiling and running the snippet
+	GoExperiment string
+	// MinGoVersion, e.g. "1.21", is the oldest go toolchain the snippet can be compiled
+	// with. If set, "go version" is checked first, and an older toolchain is reported
+	// as such rather than through whatever compile errors it would produce.
+	MinGoVersion string
+	// TempPrefix starts the names of the temporary files holding the generated code, which
+	// are named TempPrefix_<random>.go. Defaults to "gore_eval".
+	TempPrefix string
+	// DisplayFilename, if set, is the name the snippet is referred to by in errors and
+	// warnings, which then read "snippet.go:3: undefined: x" rather than ":3: undefined: x".
+	// Errors in the code gore generates around the snippet still refer to "<generated>".
+	DisplayFilename string
+	// SourceTransform, if set, rewrites the generated program just before each time it is
+	// compiled: after the snippet is wrapped in a main function and imports are added (or
+	// repaired), or as is if the snippet has a package clause. The program contains
+	// "//line :N" directives, which map its lines back to the snippet's for error
+	// messages; as long as they are kept, lines can be added or changed around them. Errors
+	// in lines added before the first directive are reported with generated line numbers.
+	SourceTransform func(src string) string
+	// OnPhase, if set, is called as the evaluation moves into each of its phases, such as
+	// PhaseCompiling and PhaseRunning, so that a front-end can show progress. It is called
+	// on the goroutine that called Eval, except with EvalMatrix, which calls it from the
+	// goroutines of its evaluations, one call at a time.
+	OnPhase func(phase string)
+
+	// where EvalTo streams the output of the evaluated code
+	output io.Writer
+	// where Compile leaves the binary, which isn't run
+	compileTo string
+	// set by EvalLines, to have p statements mark their output with their line
+	attributeLines bool
+	// set to compile with -gcflags=-e, see ShowAllErrors
+	allErrors bool
+	// the custom aliases of an Evaluator; nil for those added with RegisterAlias
+	aliases *aliasRegistry
+	// where a Session saves the generated code, over that of the previous snippet
+	srcFile string
+}
+
+// The phases reported to Options.OnPhase. "go run" compiles and runs the code in one
+// step, so in RunMode, PhaseCompiling lasts until the code has run; in BuildMode,
+// PhaseRunning follows once the code has compiled.
+const (
+	PhaseCompiling        = "compiling"
+	PhaseVetting          = "vetting"
+	PhaseRunning          = "running"
+	PhaseRepairingImports = "repairing-imports"
+)
+
+// ExecMode is how the generated code is compiled and run
+type ExecMode int
+
+const (
+	// RunMode compiles and runs the code in one go, with "go run"
+	RunMode ExecMode = iota
+	// BuildMode compiles a binary with "go build", runs it, and then deletes it
+	BuildMode
+)
+
+// ProfileKind is the kind of profile that Options.Profile asks for
+type ProfileKind int
+
+const (
+	// NoProfile, the default, doesn't profile the code
+	NoProfile ProfileKind = iota
+	// CPUProfile samples where the code spends its CPU time
+	CPUProfile
+	// HeapProfile records what the code has allocated, and what's still live
+	HeapProfile
+)
+
+// The kind as __profile expects it
+func (k ProfileKind) String() string {
+	switch k {
+	case CPUProfile:
+		return "cpu"
+	case HeapProfile:
+		return "heap"
+	}
+	return "none"
+}
+
+// An Option sets one of the fields of Options, for use with Eval:
+//
+//	Eval(code, WithTimeout(time.Second), WithGoBinary("/usr/local/go1.22/bin/go"))
+type Option func(*Options)
+
+// NewOptions applies opts, in order, to the default Options
+func NewOptions(opts ...Option) (options Options) {
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithTimeout sets Options.Timeout
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) { o.Timeout = d }
+}
+
+// WithGoBinary sets Options.GoBinary
+func WithGoBinary(path string) Option {
+	return func(o *Options) { o.GoBinary = path }
+}
+
+// WithImports adds to Options.Imports
+func WithImports(imports map[string]string) Option {
+	return func(o *Options) {
+		if o.Imports == nil {
+			o.Imports = make(map[string]string)
+		}
+		for name, path := range imports {
+			o.Imports[name] = path
+		}
+	}
+}
+
+// Environment variables to set for the go tool and the program, on top of the inherited ones
+func (opts Options) environ() (env []string) {
+	if opts.ModuleDir != "" {
+		env = append(env, "GO111MODULE=on", "GOTOOLCHAIN=local")
+	}
+	if opts.GOMAXPROCS > 0 {
+		env = append(env, fmt.Sprintf("GOMAXPROCS=%d", opts.GOMAXPROCS))
+	}
+	if opts.GoExperiment != "" {
+		env = append(env, "GOEXPERIMENT="+opts.GoExperiment)
+	}
+	if opts.GoCache != "" {
+		env = append(env, "GOCACHE="+opts.GoCache)
+	}
+	if opts.GoPath != "" {
+		env = append(env, "GOPATH="+opts.GoPath)
+	}
+	return env
+}
+
+// Whether the code is built into a binary that's then run, rather than with "go run"
+func (opts Options) buildsBinary() bool {
+	return opts.ExecMode == BuildMode || opts.output != nil || opts.CacheDiagnostics || opts.compileTo != "" ||
+		opts.Coverage || opts.stderrTag() != "" || opts.GoDebug != "" || opts.Profile != NoProfile
+}
+
+// What runTagged should put before each line written to stderr, if anything
+func (opts Options) stderrTag() string {
+	if (opts.SeparateStderr || opts.GoDebug != "") && opts.output == nil {
+		return stderrMarker
+	}
+	return opts.StderrPrefix
+}
+
+// A context for an evaluation, which expires after opts.Timeout if it's set. The caller
+// must call cancel once done with it.
+func (opts Options) context() (ctx context.Context, cancel context.CancelFunc) {
+	if opts.Timeout > 0 {
+		return context.WithTimeout(context.Background(), opts.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// Tell OnPhase, if set, that the evaluation has moved into phase
+func (opts Options) enter(phase string) {
+	if opts.OnPhase != nil {
+		opts.OnPhase(phase)
+	}
+}
+
+// The custom aliases to expand, besides the builtin ones
+func (opts Options) customAliases() []customAlias {
+	if opts.aliases == nil {
+		return customAliases.snapshot()
+	}
+	return opts.aliases.snapshot()
+}
+
+func (opts Options) goBinary() string {
+	if opts.GoBinary == "" {
+		return "go"
+	}
+	return opts.GoBinary
+}
+
+func (opts Options) tempPrefix() string {
+	if opts.TempPrefix == "" {
+		return "gore_eval"
+	}
+	return opts.TempPrefix
+}
+
+// The standard packages, along with opts.Imports
+func (opts Options) knownPkgs() map[string]string {
+	if len(opts.Imports) == 0 {
+		return builtinPkgs
+	}
+	pkgs := make(map[string]string, len(builtinPkgs)+len(opts.Imports))
+	for name, path := range builtinPkgs {
+		pkgs[name] = path
+	}
+	for name, path := range opts.Imports {
+		pkgs[name] = path
+	}
+	return pkgs
+}
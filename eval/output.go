@@ -0,0 +1,101 @@
+package eval
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Tags the lines written to stderr with SeparateStderr, for splitStderr to pick out
+const stderrMarker = "\x00gore:stderr:"
+
+// Ends, along with a newline, what either stream wrote after its last newline, so that
+// with stderrMarker, the other stream's lines still start a line of their own.
+// splitStderr removes both.
+const unterminatedMarker = "\x00gore:unterminated"
+
+// Run cmd, returning its combined output as CombinedOutput does, or streaming it to w if w
+// isn't nil. With opts.PseudoTTY, where openPty is supported, its stdout and stderr are
+// a pseudo-terminal instead of a pipe, and otherwise, with opts.StderrPrefix (or
+// SeparateStderr), its stderr lines are tagged.
+func runCmd(cmd *exec.Cmd, w io.Writer, opts Options) ([]byte, error) {
+	if opts.PseudoTTY {
+		if master, slave, err := openPty(); err == nil {
+			return runInPty(cmd, w, master, slave)
+		}
+	}
+	if tag := opts.stderrTag(); tag != "" {
+		return runTagged(cmd, w, tag)
+	}
+	if w != nil {
+		cmd.Stdout, cmd.Stderr = w, w
+		return nil, cmd.Run()
+	}
+	return cmd.CombinedOutput()
+}
+
+// Run cmd with separate pipes for stdout and stderr, merging them a line at a time into
+// its output (or w), with prefix before each line from stderr. A line is only passed on
+// once it's complete, so lines written to both at about the same time may be reordered,
+// as may a line without a newline, which waits for the program to exit. With
+// stderrMarker as the prefix, such a line is ended with unterminatedMarker.
+func runTagged(cmd *exec.Cmd, w io.Writer, prefix string) ([]byte, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if w == nil {
+		w = &buf
+	}
+	terminate := prefix == stderrMarker
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	copyLines := func(r io.Reader, prefix string) {
+		defer wg.Done()
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" && !strings.HasSuffix(line, "\n") && terminate {
+				line += unterminatedMarker + "\n"
+			}
+			if line != "" {
+				mu.Lock()
+				io.WriteString(w, prefix+line)
+				mu.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go copyLines(stdout, "")
+	go copyLines(stderr, prefix)
+	wg.Wait() // before Wait, which closes the pipes
+	return buf.Bytes(), cmd.Wait()
+}
+
+// Split output tagged with stderrMarker into the lines written to stdout and those written
+// to stderr, without the marker (or unterminatedMarker)
+func splitStderr(out string) (stdout string, stderr string) {
+	for _, line := range strings.SplitAfter(out, "\n") {
+		line = strings.TrimSuffix(line, unterminatedMarker+"\n")
+		if strings.HasPrefix(line, stderrMarker) {
+			stderr += line[len(stderrMarker):]
+		} else {
+			stdout += line
+		}
+	}
+	return stdout, stderr
+}
@@ -0,0 +1,48 @@
+package eval
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A PanicInfo is the gist of the panic that ended a run, for a front-end to show in a
+// line rather than as a wall of goroutine traces
+type PanicInfo struct {
+	Message   string // the panic value, as printed by the runtime (without "panic: ")
+	Goroutine int    // the goroutine that panicked; 0 with Options.CatchPanics, which omits it
+	Line      int    // the line of the snippet that panicked, or 0 if unknown
+}
+
+// The message of a panic ends where the runtime goes on to what it knows of the failure
+var panicPat = regexp.MustCompile(`(?s)^panic: (.*?)\n(?:\n?goroutine (\d+) \[|\tat line (\d+)\n|\[signal |exit status )`)
+
+// A frame in the snippet's code, whose lines have no file name
+var snippetFramePat = regexp.MustCompile(`(?m)^\t(?:\?\?)?:(\d+)(?: \+0x[0-9a-f]+)?$`)
+
+// Parse the output of a run that panicked, as the runtime (or __catch, with CatchPanics)
+// reports it. The line is that of the innermost frame of the panicking goroutine that's
+// in the snippet. Returns nil if failure isn't recognized as a panic.
+func parsePanic(failure string) *PanicInfo {
+	m := panicPat.FindStringSubmatchIndex(failure)
+	if m == nil {
+		return nil
+	}
+	info := &PanicInfo{Message: strings.Replace(failure[m[2]:m[3]], "\n\t", "\n", -1)}
+	if m[6] >= 0 {
+		info.Line, _ = strconv.Atoi(failure[m[6]:m[7]])
+		return info
+	}
+	trace := failure[m[3]:]
+	if g := regexp.MustCompile(`(?m)^goroutine (\d+) \[`).FindStringSubmatchIndex(trace); g != nil {
+		info.Goroutine, _ = strconv.Atoi(trace[g[2]:g[3]])
+		trace = trace[g[1]:]
+		if end := strings.Index(trace, "\n\n"); end >= 0 { // the other goroutines' traces
+			trace = trace[:end]
+		}
+		if f := snippetFramePat.FindStringSubmatch(trace); f != nil {
+			info.Line, _ = strconv.Atoi(f[1])
+		}
+	}
+	return info
+}
@@ -0,0 +1,164 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/parser"
+	"os"
+	"strings"
+)
+
+// ErrPluginsUnsupported is returned by CompilePlugin when gore isn't built with the
+// goreplugin tag
+var ErrPluginsUnsupported = errors.New("plugins are not supported; build with -tags goreplugin")
+
+// A Plugin is a snippet that CompilePlugin has compiled and loaded into this process
+type Plugin struct {
+	main func()
+}
+
+// CompilePlugin (experimental) compiles code into a Go plugin and loads it, so that it
+// can be run any number of times with Invoke, without the cost of compiling it or
+// starting a process each time. This suits a server that runs the same snippet often.
+//
+// Plugins are only supported on Linux, FreeBSD and macOS, with cgo enabled, and since
+// the plugin package links in cgo, gore must be built with "-tags goreplugin" for this
+// to work; otherwise ErrPluginsUnsupported is returned. The snippet must be compiled
+// with the same go toolchain as the host, or it won't load. A plugin can't be unloaded,
+// and its init funcs run when it is loaded. Code with a package clause isn't supported.
+func CompilePlugin(code string, opts ...Option) (*Plugin, error) {
+	sym, err := loadPlugin(code, NewOptions(opts...), pluginEntry, "GoreMain")
+	if err != nil {
+		return nil, err
+	}
+	return &Plugin{sym.(func())}, nil
+}
+
+// Compile code, with entry appended to the generated code, into a plugin and load it,
+// returning the symbol that entry declares
+func loadPlugin(code string, options Options, entry string, symbol string) (interface{}, error) {
+	if !pluginsSupported {
+		return nil, ErrPluginsUnsupported
+	}
+	if hasPackageClause(code) {
+		return nil, errors.New("a snippet with a package clause can't be compiled into a plugin")
+	}
+	ctx, cancel := options.context()
+	defer cancel()
+
+	code = expandAliases(code, options.customAliases())
+	if options.AutoCheckErr {
+		code = insertErrChecks(code)
+	}
+	topLevel, nonTopLevel, pkgsToImport, _, err := partition(code, options.knownPkgs())
+	if err != nil {
+		return nil, err
+	}
+	options.addAlwaysImports(topLevel+nonTopLevel, pkgsToImport)
+	// As in buildAndExec, the inferred imports are repaired once if they don't compile
+	for retried := false; ; retried = true {
+		sym, errs := buildPlugin(ctx, buildMain(topLevel, nonTopLevel, pkgsToImport)+entry, symbol, options)
+		if errs == "" {
+			return sym, nil
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timeout: compilation exceeded %v", options.Timeout)
+		}
+		dupsDetected := repairImports(errs, pkgsToImport)
+		added := addMissingImports(errs, topLevel, options.knownPkgs(), pkgsToImport)
+		if retried || !dupsDetected && len(added) == 0 {
+			return nil, errors.New(strings.TrimSuffix(annotateUnusedImports(errs), "\n"))
+		}
+	}
+}
+
+// The exported entry point that a plugin's generated main is called through
+const pluginEntry = "\nfunc GoreMain() { main() }\n"
+
+// Compile src into a plugin and load it, returning its symbol, or else the errors
+func buildPlugin(ctx context.Context, src string, symbol string, opts Options) (sym interface{}, errs string) {
+	dir, cleanup := genDir(opts)
+	defer cleanup()
+	tmpfile := save(dir, opts.tempPrefix(), src)
+	defer os.Remove(tmpfile)
+	lib := strings.TrimSuffix(tmpfile, ".go") + ".so"
+	defer os.Remove(lib) // not needed once loaded
+
+	out, err := command(ctx, opts, opts.goBinary(), "build", "-buildmode=plugin", "-o", lib, tmpfile).CombinedOutput()
+	if err != nil {
+		_, out = splitToolchainOutput(out)
+		return nil, formatErrors(string(out), tmpfile)
+	}
+	sym, err = openPlugin(lib, symbol)
+	if err != nil {
+		return nil, err.Error() + "\n"
+	}
+	return sym, ""
+}
+
+// Invoke runs the snippet in this process, writing its output to this process's stdout
+// and stderr. A panic is recovered, and returned as an error.
+func (p *Plugin) Invoke() (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+	p.main()
+	return nil
+}
+
+// The exported entry point that EvalValue calls, which runs the generated main, in which
+// the snippet's last expression is assigned to __value
+const valueEntry = "\nvar __value interface{}\n\nfunc GoreValue() interface{} { main(); return __value }\n"
+
+// EvalValue (experimental) evaluates code, whose last line must end in an expression,
+// and returns the value of that expression, rather than the output of the code:
+//
+//	v, err := eval.EvalValue("x := 20\nx*2 + 2") // v is int(42)
+//
+// The code is compiled into a plugin, as with CompilePlugin, which has the same platform
+// constraints: without "-tags goreplugin", ErrPluginsUnsupported is returned. The code
+// runs in this process, so that it prints to this process's stdout and stderr, and a
+// panic is returned as an error. Each call loads a plugin, which can't be unloaded, so
+// this doesn't suit code evaluated over and over. Values of types declared by the
+// snippet are returned as such, but can only be inspected through reflection.
+func EvalValue(code string, opts ...Option) (interface{}, error) {
+	before, expr, ok := splitLastExpr(code)
+	if !ok {
+		return nil, errors.New("the snippet doesn't end in an expression")
+	}
+	sym, err := loadPlugin(before+"__value = ("+expr+")", NewOptions(opts...), valueEntry, "GoreValue")
+	if err != nil {
+		return nil, err
+	}
+	return callValue(sym.(func() interface{}))
+}
+
+func callValue(f func() interface{}) (v interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+	return f(), nil
+}
+
+// Split code into the expression that its last line ends in, after any ";", and what
+// precedes it, so that the expression keeps its line number. A comment after the
+// expression is left out.
+func splitLastExpr(code string) (before string, expr string, ok bool) {
+	code = strings.TrimRight(code, " \t\r\n;")
+	// The whole line, or else the text after each ";" in it, from the first on
+	for i := strings.LastIndexByte(code, '\n') + 1; ; {
+		if e, err := parser.ParseExpr(code[i:]); err == nil {
+			return code[:i], code[i : i+int(e.End())-1], true
+		}
+		semicolon := strings.IndexByte(code[i:], ';')
+		if semicolon < 0 {
+			return "", "", false
+		}
+		i += semicolon + 1
+	}
+}
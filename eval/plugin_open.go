@@ -0,0 +1,16 @@
+//go:build goreplugin
+
+package eval
+
+import "plugin"
+
+const pluginsSupported = true
+
+// Load the plugin at path, and look up symbol in it
+func openPlugin(path string, symbol string) (interface{}, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.Lookup(symbol)
+}
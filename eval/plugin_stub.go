@@ -0,0 +1,10 @@
+//go:build !goreplugin
+
+package eval
+
+// Without the goreplugin tag, the plugin package (and with it, cgo) isn't linked in
+const pluginsSupported = false
+
+func openPlugin(path string, symbol string) (interface{}, error) {
+	return nil, ErrPluginsUnsupported
+}
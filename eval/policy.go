@@ -0,0 +1,79 @@
+package eval
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Check the imports of the generated code against opts.DenyImports, returning a compile
+// error for the first that is denied, or "" if none are. The error refers to the line
+// of the import, if the snippet has it, or else to the first line that uses the package.
+// Code that doesn't parse is left for the compiler to reject.
+func deniedImport(src string, opts Options) string {
+	if len(opts.DenyImports) == 0 {
+		return ""
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "gore.go", src, 0)
+	if err != nil {
+		return ""
+	}
+	// Generated code has the snippet's lines after "//line :N" directives, which leave
+	// their positions without a file name. A snippet with a package clause is as is.
+	generated := strings.Contains(src, "\n//line :")
+	inSnippet := func(pos token.Pos) bool {
+		return pos.IsValid() && (!generated || fset.Position(pos).Filename == "")
+	}
+	for _, spec := range f.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		if !isDenied(importPath, opts.DenyImports) {
+			continue
+		}
+		pos := spec.Pos()
+		if !inSnippet(pos) { // an inferred import
+			name := path.Base(importPath)
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			pos = firstUse(f, name)
+		}
+		line := 1
+		if inSnippet(pos) {
+			line = fset.Position(pos).Line
+		}
+		return fmt.Sprintf(":%d: import of %q is denied\n", line, importPath)
+	}
+	return ""
+}
+
+// An entry of deny denies that package, or with a "/..." suffix, that package and those
+// under it.
+func isDenied(importPath string, deny []string) bool {
+	for _, d := range deny {
+		if d == importPath {
+			return true
+		}
+		if tree := strings.TrimSuffix(d, "/..."); tree != d && (importPath == tree || strings.HasPrefix(importPath, tree+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// The position of the first selector of the form name.X in f
+func firstUse(f *ast.File, name string) (pos token.Pos) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok && !pos.IsValid() {
+			if id, ok := sel.X.(*ast.Ident); ok && id.Name == name {
+				pos = id.Pos()
+			}
+		}
+		return !pos.IsValid()
+	})
+	return pos
+}
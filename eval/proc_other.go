@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package eval
+
+import (
+	"os/exec"
+	"time"
+)
+
+// No process groups here; cancelling kills the go tool only. Don't wait
+// indefinitely for an orphaned program to close the output pipe.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.WaitDelay = time.Second
+}
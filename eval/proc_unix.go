@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+
+package eval
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run cmd in its own process group, so that cancelling it kills the program
+// spawned by "go run" as well, and not just the go tool.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,25 @@
+package eval
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+)
+
+func runInPty(cmd *exec.Cmd, w io.Writer, master *os.File, slave *os.File) ([]byte, error) {
+	defer master.Close()
+	cmd.Stdout, cmd.Stderr = slave, slave
+	err := cmd.Start()
+	slave.Close() // the program has its own copy
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if w == nil {
+		w = &buf
+	}
+	// Reading fails (with EIO) once the program, and any it started, have closed the tty
+	io.Copy(w, master)
+	return buf.Bytes(), cmd.Wait()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package eval
+
+import (
+	"errors"
+	"os"
+)
+
+// Pseudo-terminals are only opened on Linux; elsewhere, Options.PseudoTTY is a no-op
+func openPty() (master *os.File, slave *os.File, err error) {
+	return nil, nil, errors.New("pseudo-terminals are unsupported on this platform")
+}
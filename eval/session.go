@@ -0,0 +1,235 @@
+package eval
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Session evaluates a series of snippets, REPL style. Each snippet is compiled and
+// run on its own, except that the value of a snippet that's a lone expression is
+// remembered, and may be referred to as "_" in the next snippet if that is an
+// expression too, or as "$0" anywhere in it:
+//
+//	s := NewSession()
+//	s.Eval("2+3")   // prints 5
+//	s.Eval("_ * 2") // prints 10
+//
+// An expression with several values, such as a call to strconv.Atoi, has each printed on
+// a line of its own, with a trailing error labeled "error:" (and skipped if nil).
+//
+// Only values of types that can be written as Go literals (numbers, strings, bools,
+// and slices, maps and structs of them) are remembered. A Session is not safe for
+// concurrent use.
+//
+// Rather than creating a temp file for each snippet, a Session saves the generated code
+// in the same file each time, in a directory of its own that Close removes.
+type Session struct {
+	opts Options
+	// The last expression's value as a Go expression, e.g. `int(5)`. Empty if unset
+	last string
+	// the directory holding the generated code, created by the first Eval
+	dir string
+}
+
+// NewSession creates a Session that evaluates snippets with the given options
+func NewSession(opts ...Option) *Session {
+	return &Session{opts: NewOptions(opts...)}
+}
+
+// Close removes the directory that holds the Session's generated code. The Session can
+// still be used, but a later Eval creates the directory afresh.
+func (s *Session) Close() error {
+	if s.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(s.dir)
+	s.dir = ""
+	return err
+}
+
+// The options to evaluate a snippet with, which save the code in the Session's directory
+func (s *Session) options() Options {
+	if s.dir == "" {
+		parent, prefix := tempDir(), s.opts.tempPrefix()+"_session_"
+		if s.opts.ModuleDir != "" {
+			parent, prefix = absPath(s.opts.ModuleDir), "."+prefix // hidden from "./..."
+		}
+		dir, err := os.MkdirTemp(parent, prefix)
+		if err != nil {
+			return s.opts // fall back to a temp file per snippet
+		}
+		s.dir = dir
+	}
+	opts := s.opts
+	opts.srcFile = filepath.Join(s.dir, opts.tempPrefix()+".go")
+	return opts
+}
+
+// marks the output line that carries the value of an expression snippet
+const lastValueMarker = "\x00gore:last:"
+
+// Eval evaluates code as Eval does, and remembers its value if it is an expression.
+func (s *Session) Eval(code string) (out string, err string) {
+	last := s.last
+	s.last = ""
+	opts := s.options()
+
+	expr, isExpr, ok := substituteLast(code, last)
+	if !ok {
+		return "", ":1: _ is unset; the previous snippet wasn't an expression with a literal value"
+	}
+	if !isExpr || isPrintCall(expr) {
+		return EvalWithOptions(expr, opts)
+	}
+
+	// Print the value, and report it on a marked line to be stripped from the output.
+	// The helper is placed after the snippet, so as not to disturb its line numbers.
+	wrapped := "__last := " + expr + "\n__p(__last)\n__keep(__last)\n" + `
+func __keep(v interface{}) {
+	fmt.Printf("` + strings.Replace(lastValueMarker, "\x00", `\x00`, 1) + `%T(%#v)\n", v, v)
+}`
+	res := EvalResult(wrapped, opts)
+	if m := multiValuePat.FindStringSubmatch(res.Err); res.compileFailed && m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return EvalWithOptions(printResults(expr, n), opts)
+	}
+	if res.compileFailed {
+		// Not an expression with a single value after all (e.g. a call to a func
+		// with no results); evaluate it as a statement instead
+		return EvalWithOptions(expr, opts)
+	}
+	if i := strings.Index(res.Out, lastValueMarker); i >= 0 {
+		value := res.Out[i+len(lastValueMarker):]
+		if nl := strings.IndexByte(value, '\n'); nl >= 0 {
+			res.Out = res.Out[:i] + value[nl+1:]
+			value = value[:nl]
+		}
+		s.last = literal(value)
+	}
+	return res.Out, res.Err
+}
+
+// the compile error for an expression with several values assigned to __last
+var multiValuePat = regexp.MustCompile(`assignment mismatch: 1 variable but .* returns (\d+) values`)
+
+// Wrap an expression with n values so that each is printed, on a line of its own. If the
+// last is an error, it is labeled as such, and left out if nil, as in
+//
+//	s.Eval(`strconv.Atoi("x")`) // prints 0, then error: strconv.Atoi: parsing "x": invalid syntax
+//
+// Such values aren't remembered.
+func printResults(expr string, n int) string {
+	vars := make([]string, n)
+	for i := range vars {
+		vars[i] = fmt.Sprintf("&__v%d", i)
+	}
+	return strings.Replace(strings.Join(vars, ", "), "&", "", -1) + " := " + expr + "\n" +
+		"__results(" + strings.Join(vars, ", ") + ")\n" + `
+func __results(ptrs ...interface{}) {
+	for i, ptr := range ptrs {
+		if err, ok := ptr.(*error); ok && i == len(ptrs)-1 {
+			if *err != nil {
+				fmt.Println("error:", *err)
+			}
+			continue
+		}
+		__p(reflect.ValueOf(ptr).Elem().Interface())
+	}
+}`
+}
+
+// the funcs of fmt that print, and return the number of bytes written and an error
+var printFuncs = map[string]bool{
+	"Print": true, "Println": true, "Printf": true, "Fprint": true, "Fprintln": true, "Fprintf": true,
+}
+
+// Whether expr is a call of one of fmt's printFuncs, as in fmt.Println("x"), whose
+// results aren't worth printing: it is evaluated as a statement instead
+func isPrintCall(expr string) bool {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return false
+	}
+	call, ok := e.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	fun, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := fun.X.(*ast.Ident)
+	return ok && pkg.Name == "fmt" && printFuncs[fun.Sel.Name]
+}
+
+// If code is an expression, replace each "_" and "$0" in it with last, and return
+// isExpr = true. Otherwise, replace only "$0", which Go code can't contain outside
+// strings and comments. ok is false if there's a reference, but no last value.
+func substituteLast(code string, last string) (result string, isExpr bool, ok bool) {
+	text, found := replaceOutsideStrings(code, "$0", "_")
+	e, err := parser.ParseExpr(text)
+	if err != nil {
+		if found && last == "" {
+			return "", false, false
+		}
+		result, _ = replaceOutsideStrings(code, "$0", "("+last+")")
+		return result, false, true
+	}
+
+	// Replace the "_" idents from the end, so that earlier offsets remain valid
+	var offsets []int
+	ast.Inspect(e, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Name == "_" {
+			offsets = append(offsets, int(id.Pos())-1)
+		}
+		return true
+	})
+	if len(offsets) > 0 && last == "" {
+		return "", true, false
+	}
+	result = text
+	for i := len(offsets) - 1; i >= 0; i-- {
+		result = result[:offsets[i]] + "(" + last + ")" + result[offsets[i]+1:]
+	}
+	return result, true, true
+}
+
+// Replace each old in code with new, except in strings and comments, saying whether
+// there were any. A broken snippet is left for Eval to report.
+func replaceOutsideStrings(code string, old string, new string) (result string, found bool) {
+	scanner := NewScanner(code)
+	for {
+		chunk, err := nextChunk(scanner)
+		if err != nil && (err == io.EOF || chunk.text == "") {
+			return result, found
+		}
+		if chunk.kind == KTEXT && strings.Contains(chunk.text, old) {
+			found = true
+			chunk.text = strings.Replace(chunk.text, old, new, -1)
+		}
+		result += chunk.text
+	}
+}
+
+// Turn the "%T(%#v)" formatting of a value, as printed by the evaluated code, into a Go
+// expression usable in a later snippet. Returns "" for values that have no literal form.
+func literal(value string) string {
+	// Types declared in the snippet (main.T) don't outlive it
+	typ := value[:strings.Index(value+"(", "(")]
+	for _, s := range []string{"*", "func", "chan", "unsafe.", "main."} {
+		if strings.Contains(typ, s) {
+			return ""
+		}
+	}
+	if _, err := parser.ParseExpr(value); err != nil {
+		return ""
+	}
+	return value
+}
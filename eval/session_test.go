@@ -0,0 +1,84 @@
+package eval_test
+
+import (
+	"github.com/sriram-srinivasan/gore/eval"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the value of an expression is available as _ (or $0) in the next snippet
+func TestSessionLastValue(t *testing.T) {
+	s := eval.NewSession()
+	steps := []struct{ code, out, err string }{
+		{"2+3", "5", ""},
+		{"_ * 2", "10", ""},
+		{"x := $0 + 1\np x", "11", ""},
+		{"_ * 2", "", "_ is unset"}, // the previous snippet wasn't an expression
+		{`strings.ToUpper("go")`, "GO", ""},
+		{`_ + "!"`, "GO!", ""},
+		{`$0 + " costs $0" // or _`, "GO! costs $0", ""}, // not in strings or comments
+		{`"price: $0"`, "price: $0", ""},
+		{"s := `$0`\np s, $0", "$0\nprice: $0", ""},
+		{`fmt.Println("no value")`, "no value", ""}, // multiple values aren't remembered
+		{"$0", "", "_ is unset"},
+	}
+	for _, step := range steps {
+		out, err := s.Eval(step.code)
+		if ts(out) != step.out || !strings.Contains(err, step.err) || step.err == "" && err != "" {
+			t.Errorf("%q: Expected out %q, err %q. Instead got out %q, err %q", step.code, step.out, step.err, out, err)
+		}
+	}
+}
+
+// an expression with several values has each printed, and a trailing error labeled
+func TestSessionMultipleValues(t *testing.T) {
+	s := eval.NewSession()
+	steps := []struct{ code, out string }{
+		{`strconv.Atoi("42")`, "42"}, // a nil error isn't printed
+		{`strconv.Atoi("x")`, "0\nerror: strconv.Atoi: parsing \"x\": invalid syntax"},
+		{`strings.Cut("k=v", "=")`, "k\nv\ntrue"},
+		{"func() (error, int) { return nil, 1 }()", "<nil>\n1"}, // only a trailing error is labeled
+		{`fmt.Print("ab\n", 1)`, "ab\n1"},                       // the byte count isn't printed
+		{`strconv.Atoi("0")`, "0"},
+		{`strconv.Atoi("11")`, "11"}, // its digits aren't taken for a byte count
+		{`strconv.Atoi("21")`, "21"},
+		{"_", ""}, // multiple values aren't remembered
+	}
+	for _, step := range steps {
+		out, err := s.Eval(step.code)
+		if ts(out) != step.out || (err != "") != (step.out == "") {
+			t.Errorf("%q: Expected out %q. Instead got out %q, err %q", step.code, step.out, out, err)
+		}
+	}
+}
+
+// a session saves each snippet over the last, in a directory that Close removes
+func TestSessionClose(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	s := eval.NewSession(func(o *eval.Options) { o.ExecMode = eval.BuildMode })
+	for _, code := range []string{"1+2", "_ * 2", "p \"done\""} {
+		if _, err := s.Eval(code); err != "" {
+			t.Fatalf("%q: %s", code, err)
+		}
+	}
+	dirs, _ := filepath.Glob(filepath.Join(tmp, "gore_eval*"))
+	if len(dirs) != 1 {
+		t.Fatalf("Expected one session directory. Instead got %v", dirs)
+	}
+	if files, _ := os.ReadDir(dirs[0]); len(files) != 1 || files[0].Name() != "gore_eval.go" {
+		t.Errorf("Expected just gore_eval.go in %s. Instead got %v", dirs[0], files)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(tmp, "gore_eval*")); len(left) != 0 {
+		t.Errorf("Expected nothing left after Close. Instead found %v", left)
+	}
+	if out, err := s.Eval("p 7"); out != "7\n" || err != "" {
+		t.Errorf("Expected the session to be usable after Close. Instead got %q, err %q", out, err)
+	}
+	s.Close()
+}
@@ -0,0 +1,82 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The packages that snippets use most, compiled by Warm
+var warmPkgs = []string{
+	"bufio", "bytes", "encoding/json", "errors", "fmt", "io", "math", "os",
+	"regexp", "sort", "strconv", "strings", "sync", "time", "unicode",
+}
+
+// Warm primes the go build cache with the standard packages that snippets use most,
+// compiling (but not running) a program that imports them all. With an empty cache, the
+// first Eval of a snippet using, say, encoding/json and regexp can take tens of seconds,
+// as the runtime and the packages are compiled; once they are cached, an Eval takes
+// about as long as go run's startup, typically a few hundred milliseconds (compare
+// BenchmarkEvalCold and BenchmarkEvalWarm). Calling Warm when a server starts
+// front-loads that cost. opts should be the ones
+// later passed to Eval, as ModuleDir, GoBinary and the environment affect the cache.
+func Warm(opts ...Option) error {
+	options := NewOptions(opts...)
+	options.ExecMode = BuildMode
+
+	ctx, cancel := options.context()
+	defer cancel()
+
+	if res := run(ctx, importingProgram(warmPkgs), options); res.Err != "" {
+		return errors.New(res.Err)
+	}
+	return nil
+}
+
+// ValidateImports checks that each path in Options.Imports can be compiled with the go
+// tool and module that Eval would use, so that a misconfigured mapping is caught when a
+// server starts rather than when a snippet first uses it. It returns an error for each
+// path that doesn't compile, in order of package name.
+func ValidateImports(opts ...Option) []error {
+	options := NewOptions(opts...)
+	options.ExecMode = BuildMode
+
+	names := make([]string, 0, len(options.Imports))
+	paths := make([]string, 0, len(options.Imports))
+	for name, path := range options.Imports {
+		names = append(names, name)
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 || compileImports(paths, options) == "" {
+		return nil
+	}
+
+	// Something doesn't compile; find out what
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		path := options.Imports[name]
+		if msg := compileImports([]string{path}, options); msg != "" {
+			errs = append(errs, fmt.Errorf("%s (%s): %s", name, path, strings.TrimSpace(msg)))
+		}
+	}
+	return errs
+}
+
+// Compile a program importing paths, returning its errors
+func compileImports(paths []string, opts Options) string {
+	ctx, cancel := opts.context()
+	defer cancel()
+	res := run(ctx, importingProgram(paths), opts)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Sprintf("timeout: compilation exceeded %v", opts.Timeout)
+	}
+	return res.Err
+}
+
+// A program that does nothing but import paths
+func importingProgram(paths []string) string {
+	return "package main\n\nimport (\n\t_ \"" + strings.Join(paths, "\"\n\t_ \"") + "\"\n)\n\nfunc main() {}\n"
+}